@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/labstack/echo/v5"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// pastDueGrace is how long a past_due subscription keeps giving access after its current
+// period started, i.e. after the renewal payment failed. Set with STRIPE_PAST_DUE_GRACE_DAYS, none by default.
+func pastDueGrace() time.Duration {
+	days, _ := strconv.Atoi(os.Getenv("STRIPE_PAST_DUE_GRACE_DAYS"))
+	return time.Duration(max(days, 0)) * 24 * time.Hour
+}
+
+// subscriptionGrantsAccess reports whether the subscription record is active or trialing,
+// or past_due and still within the grace period
+func subscriptionGrantsAccess(record *models.Record, grace time.Duration) bool {
+	switch record.GetString("status") {
+	case "active", "trialing":
+		return true
+	case "past_due":
+		periodStart := record.GetDateTime("current_period_start")
+		return grace > 0 && !periodStart.IsZero() && time.Since(periodStart.Time()) < grace
+	}
+	return false
+}
+
+// paymentRequired writes the structured 402 returned by the billing middlewares
+func paymentRequired(c echo.Context, code string, message string, details map[string]any) error {
+	body := map[string]any{
+		"failure": message,
+		"code":    code,
+	}
+	for key, value := range details {
+		body[key] = value
+	}
+	return c.JSON(http.StatusPaymentRequired, body)
+}
+
+// billingRule is what a route or collection requires: a subscription, optionally for one of
+// the products, or an entitlement to the feature when one is set
+type billingRule struct {
+	productIds []string
+	feature    string
+}
+
+// allows reports whether the user, or their organisation, satisfies the rule
+func (r billingRule) allows(app *pocketbase.PocketBase, user *models.Record) bool {
+	if r.feature != "" {
+		return hasEntitlement(app, user.Id, r.feature)
+	}
+
+	subscriptions, err := userSubscriptions(app, user)
+	if err != nil {
+		return false
+	}
+
+	grace := pastDueGrace()
+	for _, record := range subscriptions {
+		if subscriptionGrantsAccess(record, grace) && subscriptionHasProduct(app, record, r.productIds) {
+			return true
+		}
+	}
+	return false
+}
+
+// deny writes the structured 402 for the rule
+func (r billingRule) deny(c echo.Context) error {
+	if r.feature != "" {
+		return paymentRequired(c, "entitlement_required", "your plan doesn't include "+r.feature, map[string]any{
+			"feature": r.feature,
+		})
+	}
+
+	details := map[string]any{}
+	if len(r.productIds) > 0 {
+		details["products"] = r.productIds
+	}
+	return paymentRequired(c, "subscription_required", "an active subscription is required", details)
+}
+
+func requireBilling(app *pocketbase.PocketBase, rule billingRule) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user, err := requestUser(app, c)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"failure": "Could not get user"})
+			}
+
+			if !rule.allows(app, user) {
+				return rule.deny(c)
+			}
+
+			c.Set(apis.ContextAuthRecordKey, user)
+			return next(c)
+		}
+	}
+}
+
+// RequireSubscription only lets through users with a subscription that grants access, their own or
+// their organisation's. With product ids the subscription must be for one of those products.
+func RequireSubscription(app *pocketbase.PocketBase, productIds ...string) echo.MiddlewareFunc {
+	return requireBilling(app, billingRule{productIds: productIds})
+}
+
+// RequireEntitlement only lets through users entitled to the feature. Features granted by a
+// past_due subscription count within the STRIPE_PAST_DUE_GRACE_DAYS grace period.
+func RequireEntitlement(app *pocketbase.PocketBase, feature string) echo.MiddlewareFunc {
+	return requireBilling(app, billingRule{feature: feature})
+}
+
+// subscriptionHasProduct reports whether any item of the subscription is for one of the products,
+// any product matches when none are given
+func subscriptionHasProduct(app *pocketbase.PocketBase, record *models.Record, productIds []string) bool {
+	if len(productIds) == 0 {
+		return true
+	}
+
+	for _, priceId := range subscriptionPriceIds(app, record) {
+		priceRecord, err := app.Dao().FindFirstRecordByData("price", "price_id", priceId)
+		if err != nil {
+			continue
+		}
+		for _, productId := range productIds {
+			if priceRecord.GetString("product_id") == productId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasEntitlement reports whether any of the user's grants of the feature currently gives access
+func hasEntitlement(app *pocketbase.PocketBase, userId string, feature string) bool {
+	records, err := app.Dao().FindRecordsByExpr("user_entitlement", dbx.HashExp{"user_id": userId, "feature": feature})
+	if err != nil {
+		return false
+	}
+
+	grace := pastDueGrace()
+	for _, record := range records {
+		if record.GetString("source") != "subscription" {
+			return true
+		}
+		subscription, err := app.Dao().FindFirstRecordByData("subscription", "subscription_id", record.GetString("source_id"))
+		if err == nil && subscriptionGrantsAccess(subscription, grace) {
+			return true
+		}
+	}
+	return false
+}
+
+// protectCollection enforces the rule on the collection's standard record api for the given
+// actions ("list", "view", "create", "update", "delete"). Guests get a 401 and users without
+// access the same 402 as the middlewares, admins are never restricted.
+func protectCollection(app *pocketbase.PocketBase, collection string, actions []string, rule billingRule) {
+	check := func(c echo.Context) error {
+		if admin := c.Get(apis.ContextAdminKey); admin != nil {
+			return nil
+		}
+
+		user, err := requestUser(app, c)
+		if err != nil {
+			return apis.NewUnauthorizedError("", nil)
+		}
+		if rule.allows(app, user) {
+			return nil
+		}
+
+		// the record api skips its own response once this one is written,
+		// the error only stops the request
+		if err := rule.deny(c); err != nil {
+			return err
+		}
+		return apis.NewApiError(http.StatusPaymentRequired, "payment required", nil)
+	}
+
+	for _, action := range actions {
+		switch action {
+		case "list":
+			app.OnRecordsListRequest(collection).Add(func(e *core.RecordsListEvent) error {
+				return check(e.HttpContext)
+			})
+		case "view":
+			app.OnRecordViewRequest(collection).Add(func(e *core.RecordViewEvent) error {
+				return check(e.HttpContext)
+			})
+		case "create":
+			app.OnRecordBeforeCreateRequest(collection).Add(func(e *core.RecordCreateEvent) error {
+				return check(e.HttpContext)
+			})
+		case "update":
+			app.OnRecordBeforeUpdateRequest(collection).Add(func(e *core.RecordUpdateEvent) error {
+				return check(e.HttpContext)
+			})
+		case "delete":
+			app.OnRecordBeforeDeleteRequest(collection).Add(func(e *core.RecordDeleteEvent) error {
+				return check(e.HttpContext)
+			})
+		}
+	}
+}
+
+// registerBillingBindings exposes the middlewares to pb_hooks as $billing, e.g.
+//
+//	routerAdd("GET", "/reports", (c) => { ... }, $billing.requireEntitlement("reports"))
+func registerBillingBindings(app *pocketbase.PocketBase, vm *goja.Runtime) {
+	vm.Set("$billing", map[string]any{
+		"requireSubscription": func(productIds ...string) echo.MiddlewareFunc {
+			return RequireSubscription(app, productIds...)
+		},
+		"requireEntitlement": func(feature string) echo.MiddlewareFunc {
+			return RequireEntitlement(app, feature)
+		},
+	})
+}
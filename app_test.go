@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+)
+
+// newTestApp bootstraps a pocketbase app in a temporary directory with the collections of pb_bootstrap/pb_schema.json
+func newTestApp(t *testing.T) *pocketbase.PocketBase {
+	t.Helper()
+
+	if jsonv2Experiment {
+		t.Skip("pocketbase v0.22 can't decode its collection schema with GOEXPERIMENT=jsonv2, run with GOEXPERIMENT=nojsonv2")
+	}
+
+	app := pocketbase.NewWithConfig(pocketbase.Config{
+		DefaultDataDir:  t.TempDir(),
+		HideStartBanner: true,
+	})
+	if err := app.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.ResetBootstrapState() })
+
+	runner, err := migrate.NewRunner(app.DB(), migrations.AppMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runner.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.RefreshSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile("pb_bootstrap/pb_schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collections := []*models.Collection{}
+	if err := json.Unmarshal(raw, &collections); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Dao().ImportCollections(collections, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	return app
+}
+
+// createTestRecord saves a record with the given data straight through the dao
+func createTestRecord(t *testing.T, app *pocketbase.PocketBase, collectionName string, data map[string]any) *models.Record {
+	t.Helper()
+
+	collection, err := app.Dao().FindCollectionByNameOrId(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := models.NewRecord(collection)
+	record.Load(data)
+	if collection.IsAuth() {
+		record.RefreshTokenKey()
+	}
+	if err := app.Dao().SaveRecord(record); err != nil {
+		t.Fatal(err)
+	}
+
+	return record
+}
+
+// countTestRecords counts the records of the collection matching the expression
+func countTestRecords(t *testing.T, app *pocketbase.PocketBase, collectionName string, expr dbx.Expression) int {
+	t.Helper()
+
+	records, err := app.Dao().FindRecordsByExpr(collectionName, expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(records)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/price"
+
+	"pocketbase/mapping"
+)
+
+// syncProduct upserts the product record from a stripe product
+func syncProduct(app *pocketbase.PocketBase, stripeProduct *stripe.Product, dryRun bool) (string, []string, error) {
+	existingRecord, err := app.Dao().FindFirstRecordByData("product", "product_id", stripeProduct.ID)
+	if err != nil {
+		existingRecord = nil
+	}
+
+	return saveRecordData(app, "product", existingRecord, mapping.Product(stripeProduct), dryRun)
+}
+
+// syncPrice upserts the price record from a stripe price
+func syncPrice(app *pocketbase.PocketBase, stripePrice *stripe.Price, dryRun bool) (string, []string, error) {
+	// tiers are only included when expanded
+	if stripePrice.BillingScheme == stripe.PriceBillingSchemeTiered && stripePrice.Tiers == nil {
+		params := &stripe.PriceParams{}
+		params.AddExpand("tiers")
+		latest, err := price.Get(stripePrice.ID, params)
+		if err != nil {
+			return "", nil, errors.New("couldn't retrieve price from stripe")
+		}
+		stripePrice = latest
+	}
+
+	existingRecord, err := app.Dao().FindFirstRecordByData("price", "price_id", stripePrice.ID)
+	if err != nil {
+		existingRecord = nil
+	}
+
+	result, changed, err := saveRecordData(app, "price", existingRecord, mapping.Price(stripePrice), dryRun)
+	if err != nil {
+		return "", nil, errors.New("failed to submit to pocketbase")
+	}
+
+	return result, changed, nil
+}
+
+// markProductDeleted deactivates a product that was deleted in stripe along with its prices.
+// The records are kept rather than removed since subscriptions and orders still point at them.
+func markProductDeleted(app *pocketbase.PocketBase, productId string) error {
+	existingRecord, err := app.Dao().FindFirstRecordByData("product", "product_id", productId)
+	if err == nil && existingRecord != nil {
+		if err := markDeleted(app, existingRecord); err != nil {
+			return errors.New("couldn't submit product update")
+		}
+	}
+
+	prices, err := app.Dao().FindRecordsByExpr("price", dbx.HashExp{"product_id": productId})
+	if err != nil {
+		return err
+	}
+	for _, price := range prices {
+		if err := markDeleted(app, price); err != nil {
+			return errors.New("couldn't submit price update")
+		}
+	}
+
+	return nil
+}
+
+// markPriceDeleted deactivates a price that was deleted in stripe
+func markPriceDeleted(app *pocketbase.PocketBase, priceId string) error {
+	existingRecord, err := app.Dao().FindFirstRecordByData("price", "price_id", priceId)
+	if err != nil || existingRecord == nil {
+		return nil
+	}
+
+	if err := markDeleted(app, existingRecord); err != nil {
+		return errors.New("couldn't submit price update")
+	}
+
+	return nil
+}
+
+func markDeleted(app *pocketbase.PocketBase, record *models.Record) error {
+	form := forms.NewRecordUpsert(app, record)
+	form.LoadData(map[string]any{
+		"active":  false,
+		"deleted": true,
+	})
+
+	return form.Submit()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/charge"
+	"github.com/stripe/stripe-go/v76/refund"
+
+	"pocketbase/mapping"
+)
+
+// chargeOwner is what a charge was paid for and who paid it
+type chargeOwner struct {
+	order            *models.Record
+	invoiceId        string
+	paymentIntentId  string
+	stripeCustomerId string
+	userId           string
+}
+
+// findChargeOwner resolves the order or invoice and the user behind a charge
+func findChargeOwner(app *pocketbase.PocketBase, stripeCharge *stripe.Charge) chargeOwner {
+	owner := chargeOwner{}
+
+	if stripeCharge.Invoice != nil {
+		owner.invoiceId = stripeCharge.Invoice.ID
+	}
+	if stripeCharge.PaymentIntent != nil {
+		owner.paymentIntentId = stripeCharge.PaymentIntent.ID
+		owner.order = findOrder(app, "", owner.paymentIntentId)
+	}
+	if stripeCharge.Customer != nil {
+		owner.stripeCustomerId = stripeCharge.Customer.ID
+		if existingCustomer, err := app.Dao().FindFirstRecordByData("customer", "stripe_customer_id", owner.stripeCustomerId); err == nil {
+			owner.userId = existingCustomer.GetString("user_id")
+		}
+	}
+	if owner.userId == "" && owner.order != nil {
+		owner.userId = owner.order.GetString("user_id")
+	}
+
+	return owner
+}
+
+// syncChargeRefunds records every refund of the charge against its order or invoice.
+// When the charge is fully refunded and STRIPE_REVOKE_ON_REFUND is set, the order is revoked.
+func syncChargeRefunds(app *pocketbase.PocketBase, stripeCharge *stripe.Charge) error {
+	owner := findChargeOwner(app, stripeCharge)
+
+	collection, err := app.Dao().FindCollectionByNameOrId("refund")
+	if err != nil {
+		return errors.New("collection doesn't exist")
+	}
+
+	// refunds are no longer included on the charge, so list them
+	iter := refund.List(&stripe.RefundListParams{
+		Charge: stripe.String(stripeCharge.ID),
+	})
+	for iter.Next() {
+		stripeRefund := iter.Refund()
+
+		existingRecord, err := app.Dao().FindFirstRecordByData("refund", "refund_id", stripeRefund.ID)
+		if err != nil {
+			existingRecord = models.NewRecord(collection)
+		}
+
+		form := forms.NewRecordUpsert(app, existingRecord)
+		form.LoadData(map[string]any{
+			"refund_id":          stripeRefund.ID,
+			"charge_id":          stripeCharge.ID,
+			"payment_intent_id":  owner.paymentIntentId,
+			"invoice_id":         owner.invoiceId,
+			"order_id":           recordId(owner.order),
+			"stripe_customer_id": owner.stripeCustomerId,
+			"user_id":            owner.userId,
+			"amount":             stripeRefund.Amount,
+			"currency":           stripeRefund.Currency,
+			"status":             stripeRefund.Status,
+			"reason":             stripeRefund.Reason,
+			"refunded_at":        mapping.Date(stripeRefund.Created),
+		})
+		if err := form.Submit(); err != nil {
+			return errors.New("couldn't submit refund update")
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return errors.New("couldn't retrieve refunds from stripe")
+	}
+
+	if stripeCharge.Refunded && owner.order != nil && os.Getenv("STRIPE_REVOKE_ON_REFUND") == "true" {
+		return revokeOrder(app, owner.order, orderRefunded)
+	}
+
+	return nil
+}
+
+// syncDispute records the dispute against the charge's order or invoice.
+// With STRIPE_FLAG_ON_DISPUTE set the user is flagged when a dispute is opened, and with
+// STRIPE_REVOKE_ON_REFUND set a lost dispute revokes the order like a refund would.
+func syncDispute(app *pocketbase.PocketBase, dispute *stripe.Dispute, opened bool) error {
+	if dispute.Charge == nil {
+		return errors.New("dispute has no charge")
+	}
+
+	// the charge isn't expanded on the event
+	stripeCharge, err := charge.Get(dispute.Charge.ID, nil)
+	if err != nil {
+		return errors.New("couldn't retrieve charge from stripe")
+	}
+	owner := findChargeOwner(app, stripeCharge)
+
+	collection, err := app.Dao().FindCollectionByNameOrId("dispute")
+	if err != nil {
+		return errors.New("collection doesn't exist")
+	}
+
+	existingRecord, err := app.Dao().FindFirstRecordByData("dispute", "dispute_id", dispute.ID)
+	if err != nil {
+		existingRecord = models.NewRecord(collection)
+	}
+
+	form := forms.NewRecordUpsert(app, existingRecord)
+	form.LoadData(map[string]any{
+		"dispute_id":         dispute.ID,
+		"charge_id":          stripeCharge.ID,
+		"payment_intent_id":  owner.paymentIntentId,
+		"invoice_id":         owner.invoiceId,
+		"order_id":           recordId(owner.order),
+		"stripe_customer_id": owner.stripeCustomerId,
+		"user_id":            owner.userId,
+		"amount":             dispute.Amount,
+		"currency":           dispute.Currency,
+		"status":             dispute.Status,
+		"reason":             dispute.Reason,
+		"opened_at":          mapping.Date(dispute.Created),
+	})
+	if err := form.Submit(); err != nil {
+		return errors.New("couldn't submit dispute update")
+	}
+
+	if opened && owner.userId != "" && os.Getenv("STRIPE_FLAG_ON_DISPUTE") == "true" {
+		existingUserRecord, err := app.Dao().FindRecordById("user", owner.userId)
+		if err != nil {
+			return errors.New("couldn't find user")
+		}
+
+		userForm := forms.NewRecordUpsert(app, existingUserRecord)
+		userForm.LoadData(map[string]any{
+			"billing_flagged": true,
+		})
+		if err := userForm.Submit(); err != nil {
+			return errors.New("couldn't submit user update")
+		}
+	}
+
+	if dispute.Status == stripe.DisputeStatusLost && owner.order != nil && os.Getenv("STRIPE_REVOKE_ON_REFUND") == "true" {
+		return revokeOrder(app, owner.order, orderDisputed)
+	}
+
+	return nil
+}
+
+// recordId returns the id of the record or an empty string when there is none
+func recordId(record *models.Record) string {
+	if record == nil {
+		return ""
+	}
+	return record.Id
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pocketbase/pocketbase"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+// cartItem is one line of the cart posted to /create-checkout-session
+type cartItem struct {
+	PriceId            string `json:"price_id"`
+	Quantity           int64  `json:"quantity"`
+	AdjustableQuantity bool   `json:"adjustable_quantity"`
+}
+
+// checkoutCart is a validated cart with everything the checkout session needs
+// derived from our own price and product records
+type checkoutCart struct {
+	lineItems       []*stripe.CheckoutSessionLineItemParams
+	mode            stripe.CheckoutSessionMode
+	currency        string
+	trialPeriodDays int64
+}
+
+// buildCart turns the cart into checkout line items using the synced price collection.
+// Only active prices of active products can be bought, nothing but the price id and
+// quantity is taken from the client.
+// Carts with a recurring price are checked out as a subscription, where one-time prices
+// are added to the first invoice, and carts of one-time prices only as a payment.
+// Stripe needs every price to share a currency and every recurring price to share a billing interval.
+func buildCart(app *pocketbase.PocketBase, items []cartItem) (*checkoutCart, error) {
+	if len(items) == 0 {
+		return nil, errors.New("cart is empty")
+	}
+
+	cart := &checkoutCart{
+		lineItems: make([]*stripe.CheckoutSessionLineItemParams, 0, len(items)),
+		mode:      stripe.CheckoutSessionModePayment,
+	}
+	interval := ""
+
+	for _, item := range items {
+		priceRecord, err := app.Dao().FindFirstRecordByData("price", "price_id", item.PriceId)
+		if err != nil {
+			return nil, fmt.Errorf("unknown price %q", item.PriceId)
+		}
+		if !priceRecord.GetBool("active") {
+			return nil, fmt.Errorf("price %q is no longer available", item.PriceId)
+		}
+
+		productRecord, err := app.Dao().FindFirstRecordByData("product", "product_id", priceRecord.GetString("product_id"))
+		if err != nil || !productRecord.GetBool("active") {
+			return nil, fmt.Errorf("price %q is no longer available", item.PriceId)
+		}
+
+		if cart.currency == "" {
+			cart.currency = priceRecord.GetString("currency")
+		} else if priceRecord.GetString("currency") != cart.currency {
+			return nil, errors.New("all prices must use the same currency")
+		}
+
+		lineItem := &stripe.CheckoutSessionLineItemParams{
+			Price: stripe.String(item.PriceId),
+		}
+
+		if priceRecord.GetString("type") == "recurring" {
+			cart.mode = stripe.CheckoutSessionModeSubscription
+			cart.trialPeriodDays = max(cart.trialPeriodDays, int64(priceRecord.GetInt("trial_period_days")))
+
+			priceInterval := fmt.Sprintf("%d %s", priceRecord.GetInt("interval_count"), priceRecord.GetString("interval"))
+			if interval == "" {
+				interval = priceInterval
+			} else if priceInterval != interval {
+				return nil, errors.New("all recurring prices must have the same billing interval")
+			}
+		}
+
+		// metered prices are billed on usage and don't take a quantity
+		if priceRecord.GetString("usage_type") != "metered" {
+			lineItem.Quantity = stripe.Int64(max(item.Quantity, 1))
+			if item.AdjustableQuantity {
+				lineItem.AdjustableQuantity = &stripe.CheckoutSessionLineItemAdjustableQuantityParams{
+					Enabled: stripe.Bool(true),
+				}
+			}
+		}
+
+		cart.lineItems = append(cart.lineItems, lineItem)
+	}
+
+	return cart, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/customer"
+	"github.com/stripe/stripe-go/v76/paymentmethod"
+
+	"pocketbase/mapping"
+)
+
+// activeCustomer returns the customer record of the user or organisation that hasn't been deleted in stripe
+func activeCustomer(app *pocketbase.PocketBase, owner billingOwner) (*models.Record, error) {
+	customerField, customerOwnerId := owner.customerFilter()
+
+	return app.Dao().FindFirstRecordByFilter(
+		"customer",
+		customerField+" = {:owner} && deleted = false",
+		dbx.Params{"owner": customerOwnerId},
+	)
+}
+
+// customerLocks holds a mutex per billing owner, so concurrent requests of the same owner
+// in this process don't race to create its customer
+var customerLocks sync.Map
+
+// EnsureCustomer returns the stripe customer id of the user, or of the organisation when an
+// organisation id is given, creating the customer when there is none. Callers check that the
+// user may bill for the organisation.
+//
+// A customer in stripe whose metadata names the owner is linked again rather than duplicated,
+// and creation uses an idempotency key, so a retried request gets the same customer. Across
+// processes the unique indexes on the customer collection keep a single record per owner.
+func EnsureCustomer(app *pocketbase.PocketBase, user *models.Record, organisationId string) (string, error) {
+	owner := billingOwner{userId: user.Id}
+	if organisationId != "" {
+		owner = billingOwner{organisationId: organisationId}
+	}
+	customerField, customerOwnerId := owner.customerFilter()
+
+	lock, _ := customerLocks.LoadOrStore(customerField+":"+customerOwnerId, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	if existingRecord, err := activeCustomer(app, owner); err == nil {
+		return existingRecord.GetString("stripe_customer_id"), nil
+	}
+
+	metadataKey, metadataValue := "pocketbaseUUID", user.Id
+	if owner.organisationId != "" {
+		metadataKey, metadataValue = "pocketbaseOrganisationId", owner.organisationId
+	}
+
+	stripeCustomer, err := findOrphanedCustomer(metadataKey, metadataValue)
+	if err != nil {
+		return "", err
+	}
+	if stripeCustomer == nil {
+		params := &stripe.CustomerParams{
+			Email:    stripe.String(user.GetString("email")),
+			Metadata: map[string]string{metadataKey: metadataValue},
+		}
+		if owner.userId != "" {
+			params.Name = stripe.String(customerName(user))
+		}
+
+		// deleted customers are kept, so their count tells a new customer apart from a retried one
+		previous, err := app.Dao().FindRecordsByExpr("customer", dbx.HashExp{customerField: customerOwnerId})
+		if err != nil {
+			return "", err
+		}
+		params.SetIdempotencyKey(fmt.Sprintf("pocketbase-customer-%s-%s-%d", customerField, customerOwnerId, len(previous)))
+
+		stripeCustomer, err = customer.New(params)
+		if err != nil {
+			return "", errors.New("couldn't create customer in stripe")
+		}
+	}
+
+	existingRecord, err := app.Dao().FindFirstRecordByData("customer", "stripe_customer_id", stripeCustomer.ID)
+	if err != nil {
+		existingRecord = nil
+	}
+	data := mapping.Customer(stripeCustomer)
+	data["user_id"] = owner.userId
+	data["organisation_id"] = owner.organisationId
+
+	if _, _, err := saveRecordData(app, "customer", existingRecord, data, false); err != nil {
+		// another process or the customer.created webhook linked the owner first
+		if linkedRecord, err := activeCustomer(app, owner); err == nil {
+			return linkedRecord.GetString("stripe_customer_id"), nil
+		}
+		return "", errors.New("couldn't submit customer")
+	}
+
+	return stripeCustomer.ID, nil
+}
+
+// findOrphanedCustomer searches stripe for a customer created for the owner whose record was lost,
+// e.g. when saving it failed after creating it in stripe
+func findOrphanedCustomer(metadataKey string, metadataValue string) (*stripe.Customer, error) {
+	params := &stripe.CustomerSearchParams{}
+	params.Query = fmt.Sprintf("metadata['%s']:'%s'", metadataKey, metadataValue)
+	iter := customer.Search(params)
+	for iter.Next() {
+		if stripeCustomer := iter.Customer(); !stripeCustomer.Deleted {
+			return stripeCustomer, nil
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errors.New("couldn't search customers in stripe")
+	}
+
+	return nil, nil
+}
+
+// syncCustomer writes the stripe customer's profile onto its customer record.
+// Customers created outside of pocketbase only get a record when their metadata names a user or
+// organisation that doesn't have a customer yet, everything else is left alone.
+// Events from the same second as the saved one are re-fetched from the stripe api.
+func syncCustomer(app *pocketbase.PocketBase, stripeCustomer *stripe.Customer, eventCreated int64) error {
+	existingRecord, err := app.Dao().FindFirstRecordByData("customer", "stripe_customer_id", stripeCustomer.ID)
+	if err != nil {
+		existingRecord = nil
+	}
+	// deletion is final in stripe, so a late update mustn't link the customer again
+	if existingRecord != nil && existingRecord.GetBool("deleted") {
+		return nil
+	}
+	if existingRecord != nil {
+		lastEventAt := int64(existingRecord.GetInt("last_event_at"))
+		if eventCreated < lastEventAt {
+			return nil
+		}
+		// e.g. customer.created and customer.updated are often sent within the same second
+		if eventCreated == lastEventAt {
+			latest, err := customer.Get(stripeCustomer.ID, nil)
+			if err != nil {
+				return errors.New("couldn't retrieve customer from stripe")
+			}
+			// customer.deleted marks the record
+			if latest.Deleted {
+				return nil
+			}
+			stripeCustomer = latest
+		}
+	}
+
+	if _, _, err := upsertCustomer(app, existingRecord, stripeCustomer, eventCreated, false); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// upsertCustomer writes the stripe customer onto the existing record, or creates one for the owner
+// named in its metadata. It returns the result and changed fields of saveRecordData,
+// unchanged when the customer was left alone. lastEventAt is noEvent for a customer fetched from the api.
+func upsertCustomer(app *pocketbase.PocketBase, existingRecord *models.Record, stripeCustomer *stripe.Customer, lastEventAt int64, dryRun bool) (string, []string, error) {
+	// the default payment method isn't expanded on the event
+	if stripeCustomer.InvoiceSettings != nil {
+		if paymentMethod := stripeCustomer.InvoiceSettings.DefaultPaymentMethod; paymentMethod != nil && paymentMethod.Type == "" {
+			latest, err := paymentmethod.Get(paymentMethod.ID, nil)
+			if err != nil {
+				return "", nil, errors.New("couldn't retrieve payment method from stripe")
+			}
+			stripeCustomer.InvoiceSettings.DefaultPaymentMethod = latest
+		}
+	}
+
+	data := mapping.Customer(stripeCustomer)
+	setSyncTimestamp(data, lastEventAt)
+
+	if existingRecord == nil {
+		owner := metadataOwner(app, stripeCustomer.Metadata)
+		if owner.userId == "" && owner.organisationId == "" {
+			return syncUnchanged, nil, nil
+		}
+		if _, err := activeCustomer(app, owner); err == nil {
+			return syncUnchanged, nil, nil
+		}
+		data["user_id"] = owner.userId
+		data["organisation_id"] = owner.organisationId
+	}
+
+	result, changed, err := saveRecordData(app, "customer", existingRecord, data, dryRun)
+	if err != nil {
+		return "", nil, errors.New("couldn't submit customer update")
+	}
+
+	return result, changed, nil
+}
+
+// metadataOwner returns the user or organisation named in the metadata pocketbase sets on the customers it creates
+func metadataOwner(app *pocketbase.PocketBase, metadata map[string]string) billingOwner {
+	if organisationId := metadata["pocketbaseOrganisationId"]; organisationId != "" {
+		return billingOwner{organisationId: organisationId}
+	}
+	if userId := metadata["pocketbaseUUID"]; userId != "" {
+		if _, err := app.Dao().FindRecordById("user", userId); err == nil {
+			return billingOwner{userId: userId}
+		}
+	}
+
+	return billingOwner{}
+}
+
+// markCustomerDeleted unlinks a customer that was deleted in stripe from its user or organisation.
+// The record is kept with deleted set so that late invoice and subscription events still find
+// their owner, but it no longer counts as the owner's customer and checkout or the portal
+// create a new one.
+func markCustomerDeleted(app *pocketbase.PocketBase, customerId string) error {
+	existingRecord, err := app.Dao().FindFirstRecordByData("customer", "stripe_customer_id", customerId)
+	if err != nil || existingRecord == nil {
+		return nil
+	}
+
+	form := forms.NewRecordUpsert(app, existingRecord)
+	form.LoadData(map[string]any{
+		"deleted":                true,
+		"default_payment_method": nil,
+	})
+	if err := form.Submit(); err != nil {
+		return errors.New("couldn't submit customer update")
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+func TestSyncCustomerIgnoresEventsOlderThanAnUnchangedOne(t *testing.T) {
+	app := newTestApp(t)
+	createTestRecord(t, app, "customer", map[string]any{"stripe_customer_id": "cus_test", "user_id": "u1"})
+
+	current := &stripe.Customer{ID: "cus_test", Email: "new@example.com"}
+	previous := &stripe.Customer{ID: "cus_test", Email: "old@example.com"}
+
+	// A at 10, C at 30 with the same data as A, then B from 20 arrives late
+	for _, event := range []struct {
+		customer *stripe.Customer
+		created  int64
+	}{{current, 10}, {current, 30}, {previous, 20}} {
+		if err := syncCustomer(app, event.customer, event.created); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record, err := app.Dao().FindFirstRecordByData("customer", "stripe_customer_id", "cus_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.GetString("email") != "new@example.com" || record.GetInt("last_event_at") != 30 {
+		t.Fatalf("expected the stale event to be ignored, got %s at %d", record.GetString("email"), record.GetInt("last_event_at"))
+	}
+}
+
+func TestRepairCustomerReportsProfileDrift(t *testing.T) {
+	app := newTestApp(t)
+	record := createTestRecord(t, app, "customer", map[string]any{"stripe_customer_id": "cus_test", "user_id": "u1", "email": "old@example.com"})
+
+	stripeCustomer := &stripe.Customer{ID: "cus_test", Email: "new@example.com", Delinquent: true}
+	entry := repairCustomer(app, record, stripeCustomer)
+	if entry == nil || !entry.Repaired {
+		t.Fatalf("expected the customer to be repaired, got %+v", entry)
+	}
+	if strings.Join(entry.Fields, ",") != "delinquent,email" {
+		t.Errorf("expected delinquent and email to be reported, got %v", entry.Fields)
+	}
+
+	saved, err := app.Dao().FindRecordById("customer", record.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.GetString("email") != "new@example.com" || !saved.GetBool("delinquent") {
+		t.Errorf("expected the profile to be saved, got %s %v", saved.GetString("email"), saved.GetBool("delinquent"))
+	}
+
+	// nothing left to repair
+	if entry := repairCustomer(app, saved, stripeCustomer); entry != nil {
+		t.Errorf("expected no drift, got %+v", entry)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/customer"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+// driftEntry describes one record that didn't match stripe
+type driftEntry struct {
+	Collection string   `json:"collection"`
+	Id         string   `json:"id"`
+	Issue      string   `json:"issue"`
+	Fields     []string `json:"fields,omitempty"`
+	Repaired   bool     `json:"repaired"`
+}
+
+// startDriftDetection schedules the drift check with STRIPE_DRIFT_SCHEDULE (every 6 hours by default).
+// Set the schedule to "off" to disable it.
+func startDriftDetection(app *pocketbase.PocketBase) *cron.Cron {
+	schedule := os.Getenv("STRIPE_DRIFT_SCHEDULE")
+	if schedule == "" {
+		schedule = "0 */6 * * *"
+	}
+
+	scheduler := cron.New()
+	if schedule == "off" {
+		return scheduler
+	}
+
+	sampleSize, _ := strconv.Atoi(os.Getenv("STRIPE_DRIFT_SAMPLE_SIZE"))
+	scheduler.MustAdd("stripe_drift", schedule, func() {
+		if err := detectDrift(app, sampleSize); err != nil {
+			app.Logger().Error("stripe drift detection failed", "error", err)
+		}
+	})
+	scheduler.Start()
+
+	return scheduler
+}
+
+// detectDrift compares the subscriptions that haven't ended and the customers with the stripe api,
+// repairs both through the shared upserts, unlinks customers deleted in stripe and saves a
+// stripe_drift_report record.
+// With a sampleSize above 0 only that many random records of each collection are compared,
+// otherwise everything is, including active stripe subscriptions missing from pocketbase.
+func detectDrift(app *pocketbase.PocketBase, sampleSize int) error {
+	startedAt := types.NowDateTime()
+	entries := []driftEntry{}
+	checked := 0
+
+	limit := max(sampleSize, 0)
+	sort := "@random"
+	if limit == 0 {
+		sort = ""
+	}
+
+	// subscriptions
+	subscriptions, err := app.Dao().FindRecordsByFilter(
+		"subscription",
+		"status = 'active' || status = 'trialing' || status = 'past_due' || status = 'unpaid' || status = 'incomplete'",
+		sort,
+		limit,
+		0,
+	)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, record := range subscriptions {
+		checked++
+		seen[record.GetString("subscription_id")] = true
+
+		subscription, err := stripeSubscription.Get(record.GetString("subscription_id"), nil)
+		if err != nil {
+			entries = append(entries, driftEntry{
+				Collection: "subscription",
+				Id:         record.GetString("subscription_id"),
+				Issue:      "couldn't retrieve from stripe: " + err.Error(),
+			})
+			continue
+		}
+
+		if entry := repairSubscription(app, record, subscription); entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+
+	if limit == 0 {
+		iter := stripeSubscription.List(&stripe.SubscriptionListParams{
+			Status: stripe.String("active"),
+		})
+		for iter.Next() {
+			subscription := iter.Subscription()
+			if seen[subscription.ID] {
+				continue
+			}
+			checked++
+
+			existingRecord, err := app.Dao().FindFirstRecordByData("subscription", "subscription_id", subscription.ID)
+			if err != nil {
+				existingRecord = nil
+			}
+			if entry := repairSubscription(app, existingRecord, subscription); entry != nil {
+				entries = append(entries, *entry)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+
+	// customers
+	customers, err := app.Dao().FindRecordsByFilter("customer", "stripe_customer_id != '' && deleted = false", sort, limit, 0)
+	if err != nil {
+		return err
+	}
+	for _, record := range customers {
+		checked++
+
+		params := &stripe.CustomerParams{}
+		params.AddExpand("invoice_settings.default_payment_method")
+		stripeCustomer, err := customer.Get(record.GetString("stripe_customer_id"), params)
+		if err != nil {
+			entries = append(entries, driftEntry{
+				Collection: "customer",
+				Id:         record.GetString("stripe_customer_id"),
+				Issue:      "couldn't retrieve from stripe: " + err.Error(),
+			})
+			continue
+		}
+		if stripeCustomer.Deleted {
+			entries = append(entries, driftEntry{
+				Collection: "customer",
+				Id:         record.GetString("stripe_customer_id"),
+				Issue:      "deleted in stripe",
+				Repaired:   markCustomerDeleted(app, record.GetString("stripe_customer_id")) == nil,
+			})
+			continue
+		}
+
+		if entry := repairCustomer(app, record, stripeCustomer); entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+
+	return saveDriftReport(app, startedAt, sampleSize, checked, entries)
+}
+
+// repairSubscription upserts the stripe subscription when the record is missing or differs
+func repairSubscription(app *pocketbase.PocketBase, existingRecord *models.Record, subscription *stripe.Subscription) *driftEntry {
+	entry := &driftEntry{
+		Collection: "subscription",
+		Id:         subscription.ID,
+	}
+
+	owner, err := subscriptionOwner(app, subscription)
+	if err != nil {
+		entry.Issue = err.Error()
+		return entry
+	}
+
+	result, changed, err := upsertSubscription(app, existingRecord, subscription, owner, noEvent, false)
+	if err != nil {
+		entry.Issue = err.Error()
+		return entry
+	}
+
+	switch result {
+	case syncCreated:
+		entry.Issue = "missing"
+	case syncUpdated:
+		entry.Issue = "out of date"
+		entry.Fields = changed
+	default:
+		return nil
+	}
+	entry.Repaired = true
+
+	return entry
+}
+
+// repairCustomer upserts the stripe customer's profile when the record differs
+func repairCustomer(app *pocketbase.PocketBase, existingRecord *models.Record, stripeCustomer *stripe.Customer) *driftEntry {
+	entry := &driftEntry{
+		Collection: "customer",
+		Id:         stripeCustomer.ID,
+	}
+
+	result, changed, err := upsertCustomer(app, existingRecord, stripeCustomer, noEvent, false)
+	if err != nil {
+		entry.Issue = err.Error()
+		return entry
+	}
+	if result != syncUpdated {
+		return nil
+	}
+
+	entry.Issue = "out of date"
+	entry.Fields = changed
+	entry.Repaired = true
+
+	return entry
+}
+
+func saveDriftReport(app *pocketbase.PocketBase, startedAt types.DateTime, sampleSize int, checked int, entries []driftEntry) error {
+	collection, err := app.Dao().FindCollectionByNameOrId("stripe_drift_report")
+	if err != nil {
+		return err
+	}
+
+	repaired := 0
+	for _, entry := range entries {
+		if entry.Repaired {
+			repaired++
+		}
+	}
+
+	mode := "full"
+	if sampleSize > 0 {
+		mode = fmt.Sprintf("sample of %d", sampleSize)
+	}
+
+	form := forms.NewRecordUpsert(app, models.NewRecord(collection))
+	form.LoadData(map[string]any{
+		"started_at":  startedAt,
+		"finished_at": types.NowDateTime(),
+		"mode":        mode,
+		"checked":     checked,
+		"drifted":     len(entries),
+		"repaired":    repaired,
+		"details":     entries,
+	})
+
+	return form.Submit()
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v5"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// features are declared in the stripe metadata of a product or price as "feature.<key>",
+// with "true" for a plain feature or a number for a limit, e.g. "feature.projects": "10".
+// A price's metadata overrides its product's for the same key.
+const featurePrefix = "feature."
+
+// subscription statuses that still grant entitlements, past_due is kept so access can be
+// given a grace period instead of being cut off on the first failed payment
+var entitledStatuses = []string{"active", "trialing", "past_due"}
+
+// entitlement is a feature a user has, merged over everything that grants it
+type entitlement struct {
+	Feature   string `json:"feature"`
+	Limit     int64  `json:"limit"`
+	Unlimited bool   `json:"unlimited"`
+	// the best status among the grants, "paid" for one-time purchases
+	Status string `json:"status"`
+}
+
+// higher ranks win when the same feature is granted more than once
+var entitlementStatusRank = map[string]int{
+	"past_due": 1,
+	"trialing": 2,
+	"active":   3,
+	"paid":     3,
+}
+
+// priceFeatures returns the features granted by the price and its product
+func priceFeatures(app *pocketbase.PocketBase, priceId string) map[string]entitlement {
+	features := map[string]entitlement{}
+
+	priceRecord, err := app.Dao().FindFirstRecordByData("price", "price_id", priceId)
+	if err != nil {
+		return features
+	}
+	if productRecord, err := app.Dao().FindFirstRecordByData("product", "product_id", priceRecord.GetString("product_id")); err == nil {
+		addMetadataFeatures(features, productRecord)
+	}
+	addMetadataFeatures(features, priceRecord)
+
+	return features
+}
+
+func addMetadataFeatures(features map[string]entitlement, record *models.Record) {
+	metadata := map[string]string{}
+	if err := record.UnmarshalJSONField("metadata", &metadata); err != nil {
+		return
+	}
+
+	for key, value := range metadata {
+		feature := strings.TrimPrefix(key, featurePrefix)
+		if feature == key || feature == "" {
+			continue
+		}
+
+		if value == "true" {
+			features[feature] = entitlement{Feature: feature, Unlimited: true}
+		} else if limit, err := strconv.ParseInt(value, 10, 64); err == nil {
+			features[feature] = entitlement{Feature: feature, Limit: limit}
+		} else {
+			// "false" or anything else takes the feature away, e.g. on a cheaper price of the product
+			delete(features, feature)
+		}
+	}
+}
+
+// refreshEntitlements rebuilds the user's user_entitlement records from their subscriptions,
+// and paid orders, including their organisation's
+func refreshEntitlements(app *pocketbase.PocketBase, userId string) error {
+	user, err := app.Dao().FindRecordById("user", userId)
+	if err != nil {
+		// deleted users keep nothing
+		return deleteEntitlements(app.Dao(), userId)
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("user_entitlement")
+	if err != nil {
+		return err
+	}
+
+	grants := []map[string]any{}
+	grant := func(source string, sourceId string, priceId string, status string) {
+		for _, feature := range priceFeatures(app, priceId) {
+			grants = append(grants, map[string]any{
+				"user_id":   user.Id,
+				"feature":   feature.Feature,
+				"limit":     feature.Limit,
+				"unlimited": feature.Unlimited,
+				"status":    status,
+				"source":    source,
+				"source_id": sourceId,
+				"price_id":  priceId,
+			})
+		}
+	}
+
+	subscriptions, err := userSubscriptions(app, user)
+	if err != nil {
+		return err
+	}
+	for _, record := range subscriptions {
+		status := record.GetString("status")
+		if !isEntitledStatus(status) {
+			continue
+		}
+		for _, priceId := range subscriptionPriceIds(app, record) {
+			grant("subscription", record.GetString("subscription_id"), priceId, status)
+		}
+	}
+
+	orders, err := userPaidOrders(app, user)
+	if err != nil {
+		return err
+	}
+	for _, record := range orders {
+		lineItems := []struct {
+			PriceId string `json:"price_id"`
+		}{}
+		if err := record.UnmarshalJSONField("line_items", &lineItems); err != nil {
+			continue
+		}
+		for _, lineItem := range lineItems {
+			grant("order", record.Id, lineItem.PriceId, orderPaid)
+		}
+	}
+
+	userData := billingUserData(app, subscriptions, grants)
+
+	return app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		if err := deleteEntitlements(txDao, user.Id); err != nil {
+			return err
+		}
+
+		// only save the user when something changed, so its updated date and hooks aren't touched on every sync
+		if len(changedFields(user, userData)) > 0 {
+			form := forms.NewRecordUpsert(app, user)
+			form.SetDao(txDao)
+			form.LoadData(userData)
+			if err := form.Submit(); err != nil {
+				return err
+			}
+		}
+
+		for _, data := range grants {
+			form := forms.NewRecordUpsert(app, models.NewRecord(collection))
+			form.SetDao(txDao)
+			form.LoadData(data)
+			if err := form.Submit(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// billingUserData returns the plan, subscription_status and entitlements fields maintained on the
+// user so collection api rules can check them, e.g. @request.auth.subscription_status = "active".
+// The plan is the product of the user's best subscription, also counting their organisation's.
+func billingUserData(app *pocketbase.PocketBase, subscriptions []*models.Record, grants []map[string]any) map[string]any {
+	var best *models.Record
+	for _, record := range subscriptions {
+		if best == nil || entitlementStatusRank[record.GetString("status")] > entitlementStatusRank[best.GetString("status")] {
+			best = record
+		}
+	}
+
+	plan := ""
+	status := ""
+	if best != nil {
+		status = best.GetString("status")
+		if isEntitledStatus(status) {
+			if priceRecord, err := app.Dao().FindFirstRecordByData("price", "price_id", best.GetString("price_id")); err == nil {
+				plan = priceRecord.GetString("product_id")
+			}
+		}
+	}
+
+	features := []string{}
+	seen := map[string]bool{}
+	for _, data := range grants {
+		feature := data["feature"].(string)
+		if !seen[feature] {
+			seen[feature] = true
+			features = append(features, feature)
+		}
+	}
+	sort.Strings(features)
+
+	return map[string]any{
+		"plan":                plan,
+		"subscription_status": status,
+		"entitlements":        features,
+	}
+}
+
+func deleteEntitlements(dao *daos.Dao, userId string) error {
+	records, err := dao.FindRecordsByExpr("user_entitlement", dbx.HashExp{"user_id": userId})
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := dao.DeleteRecord(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isEntitledStatus(status string) bool {
+	for _, entitled := range entitledStatuses {
+		if status == entitled {
+			return true
+		}
+	}
+	return false
+}
+
+// userEntitlements returns the user's materialised entitlements merged by feature.
+// An unlimited grant beats a limit and the highest limit wins.
+func userEntitlements(app *pocketbase.PocketBase, userId string) (map[string]*entitlement, error) {
+	records, err := app.Dao().FindRecordsByExpr("user_entitlement", dbx.HashExp{"user_id": userId})
+	if err != nil {
+		return nil, err
+	}
+
+	entitlements := map[string]*entitlement{}
+	for _, record := range records {
+		feature := record.GetString("feature")
+		status := record.GetString("status")
+
+		current, ok := entitlements[feature]
+		if !ok {
+			entitlements[feature] = &entitlement{
+				Feature:   feature,
+				Limit:     int64(record.GetInt("limit")),
+				Unlimited: record.GetBool("unlimited"),
+				Status:    status,
+			}
+			continue
+		}
+
+		current.Unlimited = current.Unlimited || record.GetBool("unlimited")
+		current.Limit = max(current.Limit, int64(record.GetInt("limit")))
+		if entitlementStatusRank[status] > entitlementStatusRank[current.Status] {
+			current.Status = status
+		}
+	}
+
+	return entitlements, nil
+}
+
+// entitlementsHandler returns the requesting user's entitlements keyed by feature
+func entitlementsHandler(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := requestUser(app, c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "Could not get user"})
+		}
+
+		entitlements, err := userEntitlements(app, user.Id)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "Could not get entitlements"})
+		}
+
+		return c.JSON(http.StatusOK, entitlements)
+	}
+}
+
+// entitledUserIds returns the users a subscription or order record grants entitlements to,
+// every member for an organisation subscription
+func entitledUserIds(app *pocketbase.PocketBase, record *models.Record) []string {
+	userIds := []string{}
+	if userId := record.GetString("user_id"); userId != "" {
+		userIds = append(userIds, userId)
+	}
+
+	if organisationId := record.GetString("organisation_id"); organisationId != "" {
+		members, err := app.Dao().FindRecordsByExpr("user", dbx.HashExp{"organisation_id": organisationId})
+		if err != nil {
+			app.Logger().Error("couldn't list organisation members", "organisation", organisationId, "error", err)
+		}
+		for _, member := range members {
+			userIds = append(userIds, member.Id)
+		}
+	}
+
+	return userIds
+}
+
+// registerEntitlementHooks refreshes the entitlements of everyone affected whenever a
+// subscription or order record changes, however it was written, and when a user changes
+// organisation or is deleted
+func registerEntitlementHooks(app *pocketbase.PocketBase) {
+	refresh := func(userIds ...string) {
+		seen := map[string]bool{}
+		for _, userId := range userIds {
+			if seen[userId] {
+				continue
+			}
+			seen[userId] = true
+			if err := refreshEntitlements(app, userId); err != nil {
+				app.Logger().Error("entitlement refresh failed", "user", userId, "error", err)
+			}
+		}
+	}
+
+	onBillingChange := func(e *core.ModelEvent) error {
+		record := e.Model.(*models.Record)
+		refresh(append(entitledUserIds(app, record.OriginalCopy()), entitledUserIds(app, record)...)...)
+		return nil
+	}
+	app.OnModelAfterCreate("subscription", "order").Add(onBillingChange)
+	app.OnModelAfterUpdate("subscription", "order").Add(onBillingChange)
+	app.OnModelAfterDelete("subscription", "order").Add(onBillingChange)
+
+	// items are synced before their subscription, so this only matters when the items change
+	// but the subscription record itself doesn't
+	onItemChange := func(e *core.ModelEvent) error {
+		subscription, err := app.Dao().FindFirstRecordByData("subscription", "subscription_id", e.Model.(*models.Record).GetString("subscription_id"))
+		if err == nil {
+			refresh(entitledUserIds(app, subscription)...)
+		}
+		return nil
+	}
+	app.OnModelAfterCreate("subscription_item").Add(onItemChange)
+	app.OnModelAfterUpdate("subscription_item").Add(onItemChange)
+	app.OnModelAfterDelete("subscription_item").Add(onItemChange)
+
+	// also for users without an organisation, so billing fields set on create are replaced
+	app.OnModelAfterCreate("user").Add(func(e *core.ModelEvent) error {
+		refresh(e.Model.GetId())
+		return nil
+	})
+	app.OnModelAfterUpdate("user").Add(func(e *core.ModelEvent) error {
+		record := e.Model.(*models.Record)
+		if record.OriginalCopy().GetString("organisation_id") != record.GetString("organisation_id") {
+			refresh(record.Id)
+		}
+		return nil
+	})
+	app.OnModelAfterDelete("user").Add(func(e *core.ModelEvent) error {
+		refresh(e.Model.GetId())
+		return nil
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pocketbase/dbx"
+)
+
+func TestUserCreateResetsBillingFields(t *testing.T) {
+	app := newTestApp(t)
+	registerEntitlementHooks(app)
+
+	user := createTestRecord(t, app, "user", map[string]any{
+		"username":            "forger",
+		"displayName":         "Forger",
+		"lastSeen":            "2024-01-01 00:00:00.000Z",
+		"role":                "User",
+		"plan":                "prod_pro",
+		"subscription_status": "active",
+		"entitlements":        []string{"export"},
+	})
+
+	saved, err := app.Dao().FindRecordById("user", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.GetString("plan") != "" || saved.GetString("subscription_status") != "" {
+		t.Errorf("expected no plan or status, got %q and %q", saved.GetString("plan"), saved.GetString("subscription_status"))
+	}
+	if entitlements := saved.GetStringSlice("entitlements"); len(entitlements) != 0 {
+		t.Errorf("expected no entitlements, got %v", entitlements)
+	}
+}
+
+func TestOrganisationOrdersGrantMembersFeatures(t *testing.T) {
+	app := newTestApp(t)
+	createTestRecord(t, app, "product", map[string]any{"product_id": "prod_pack", "active": true, "metadata": map[string]string{"feature.export": "true"}})
+	createTestRecord(t, app, "price", map[string]any{"price_id": "price_pack", "product_id": "prod_pack", "active": true, "type": "one_time"})
+	member := createTestRecord(t, app, "user", map[string]any{
+		"username":        "member",
+		"displayName":     "Member",
+		"lastSeen":        "2024-01-01 00:00:00.000Z",
+		"role":            "User",
+		"organisation_id": "org1",
+	})
+	createTestRecord(t, app, "order", map[string]any{
+		"checkout_session_id": "cs_org",
+		"organisation_id":     "org1",
+		"status":              orderPaid,
+		"line_items":          []map[string]any{{"price_id": "price_pack", "quantity": 1}},
+	})
+
+	if err := refreshEntitlements(app, member.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := countTestRecords(t, app, "user_entitlement", dbx.HashExp{"user_id": member.Id, "feature": "export"}); count != 1 {
+		t.Fatalf("expected the organisation's order to grant export, got %d entitlements", count)
+	}
+}
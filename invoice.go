@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/invoice"
+
+	"pocketbase/mapping"
+)
+
+// syncInvoice upserts the invoice record from a stripe invoice, linking it to the
+// customer's user and, for subscription invoices, to the subscription.
+// Like subscriptions, invoices written from a newer event are left alone, and when the
+// order can't be told apart the invoice is re-fetched from the stripe api.
+func syncInvoice(app *pocketbase.PocketBase, stripeInvoice *stripe.Invoice, eventCreated int64) error {
+	existingRecord, err := app.Dao().FindFirstRecordByData("invoice", "invoice_id", stripeInvoice.ID)
+	if err != nil {
+		existingRecord = nil
+	}
+	if existingRecord != nil {
+		lastEventAt := int64(existingRecord.GetInt("last_event_at"))
+		if eventCreated < lastEventAt {
+			return nil
+		}
+		// e.g. invoice.finalized and invoice.paid are usually sent within the same second
+		if eventCreated == lastEventAt {
+			latest, err := invoice.Get(stripeInvoice.ID, nil)
+			if err != nil {
+				return errors.New("couldn't retrieve invoice from stripe")
+			}
+			stripeInvoice = latest
+		}
+	}
+
+	data := mapping.Invoice(stripeInvoice)
+	if data["stripe_customer_id"] == "" {
+		return errors.New("invoice has no customer")
+	}
+	existingCustomer, err := app.Dao().FindFirstRecordByData("customer", "stripe_customer_id", data["stripe_customer_id"])
+	if err != nil {
+		return errors.New("no customer")
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("invoice")
+	if err != nil {
+		return errors.New("collection doesn't exist")
+	}
+
+	lines, err := invoiceLines(stripeInvoice)
+	if err != nil {
+		return errors.New("couldn't retrieve invoice lines from stripe")
+	}
+
+	var form *forms.RecordUpsert
+
+	if existingRecord != nil {
+		form = forms.NewRecordUpsert(app, existingRecord)
+	} else {
+		form = forms.NewRecordUpsert(app, models.NewRecord(collection))
+	}
+
+	data["user_id"] = existingCustomer.GetString("user_id")
+	data["organisation_id"] = existingCustomer.GetString("organisation_id")
+	data["lines"] = lines
+	data["last_event_at"] = eventCreated
+	form.LoadData(data)
+	if err := form.Submit(); err != nil {
+		return errors.New("couldn't submit invoice update")
+	}
+
+	return nil
+}
+
+// invoiceLines flattens the invoice line items, paging through the stripe api
+// when the event only carried the first page
+func invoiceLines(stripeInvoice *stripe.Invoice) ([]map[string]any, error) {
+	var items []*stripe.InvoiceLineItem
+	if stripeInvoice.Lines != nil {
+		items = stripeInvoice.Lines.Data
+	}
+
+	if stripeInvoice.Lines == nil || stripeInvoice.Lines.HasMore {
+		items = nil
+		iter := invoice.ListLines(&stripe.InvoiceListLinesParams{
+			Invoice: stripe.String(stripeInvoice.ID),
+		})
+		for iter.Next() {
+			items = append(items, iter.InvoiceLineItem())
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	lines := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		if line := mapping.InvoiceLine(item); line != nil {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,7 @@
+//go:build goexperiment.jsonv2
+
+package main
+
+// pocketbase v0.22 decodes its collection schema through a pointer alias that recurses
+// forever under the jsonv2 experiment, so newTestApp skips the tests that need a database
+const jsonv2Experiment = true
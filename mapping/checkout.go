@@ -0,0 +1,41 @@
+package mapping
+
+import "github.com/stripe/stripe-go/v76"
+
+// CheckoutSession maps a payment mode checkout session onto the fields of its order record,
+// without the line items, status and user, which are set by the caller
+func CheckoutSession(session *stripe.CheckoutSession) map[string]any {
+	if session == nil {
+		return nil
+	}
+
+	return map[string]any{
+		"checkout_session_id": session.ID,
+		"payment_intent_id":   PaymentIntentID(session.PaymentIntent),
+		"amount_total":        session.AmountTotal,
+		"currency":            session.Currency,
+		"metadata":            session.Metadata,
+	}
+}
+
+// CheckoutLineItem maps a line item of a checkout session onto an entry of the order record's line_items
+func CheckoutLineItem(item *stripe.LineItem) map[string]any {
+	if item == nil {
+		return nil
+	}
+
+	data := map[string]any{
+		"line_id":      item.ID,
+		"description":  item.Description,
+		"quantity":     item.Quantity,
+		"amount_total": item.AmountTotal,
+		"currency":     item.Currency,
+		"price_id":     PriceID(item.Price),
+		"product_id":   "",
+	}
+	if item.Price != nil {
+		data["product_id"] = ProductID(item.Price.Product)
+	}
+
+	return data
+}
@@ -0,0 +1,51 @@
+package mapping
+
+import "github.com/stripe/stripe-go/v76"
+
+// Customer maps a stripe customer onto the stripe fields of its customer record,
+// the user or organisation it belongs to is set by the caller
+func Customer(customer *stripe.Customer) map[string]any {
+	if customer == nil {
+		return nil
+	}
+
+	data := map[string]any{
+		"stripe_customer_id":     customer.ID,
+		"email":                  customer.Email,
+		"name":                   customer.Name,
+		"phone":                  customer.Phone,
+		"address":                customer.Address,
+		"tax_exempt":             customer.TaxExempt,
+		"default_payment_method": nil,
+		"balance":                customer.Balance,
+		"currency":               customer.Currency,
+		"delinquent":             customer.Delinquent,
+		"deleted":                customer.Deleted,
+	}
+	if customer.InvoiceSettings != nil {
+		data["default_payment_method"] = PaymentMethod(customer.InvoiceSettings.DefaultPaymentMethod)
+	}
+
+	return data
+}
+
+// PaymentMethod summarises a payment method without anything sensitive, only the type and for
+// cards the brand, last four digits and expiry. An unexpanded payment method only has its id.
+func PaymentMethod(paymentMethod *stripe.PaymentMethod) map[string]any {
+	if paymentMethod == nil {
+		return nil
+	}
+
+	data := map[string]any{
+		"id":   paymentMethod.ID,
+		"type": paymentMethod.Type,
+	}
+	if paymentMethod.Card != nil {
+		data["brand"] = paymentMethod.Card.Brand
+		data["last4"] = paymentMethod.Card.Last4
+		data["exp_month"] = paymentMethod.Card.ExpMonth
+		data["exp_year"] = paymentMethod.Card.ExpYear
+	}
+
+	return data
+}
@@ -0,0 +1,55 @@
+package mapping
+
+import "github.com/stripe/stripe-go/v76"
+
+// Invoice maps a stripe invoice onto the fields of its invoice record,
+// without the lines and the user, which are set by the caller
+func Invoice(invoice *stripe.Invoice) map[string]any {
+	if invoice == nil {
+		return nil
+	}
+
+	return map[string]any{
+		"invoice_id":         invoice.ID,
+		"stripe_customer_id": CustomerID(invoice.Customer),
+		"subscription_id":    SubscriptionID(invoice.Subscription),
+		"number":             invoice.Number,
+		"status":             invoice.Status,
+		"currency":           invoice.Currency,
+		"subtotal":           invoice.Subtotal,
+		"total":              invoice.Total,
+		"amount_due":         invoice.AmountDue,
+		"amount_paid":        invoice.AmountPaid,
+		"amount_remaining":   invoice.AmountRemaining,
+		"hosted_invoice_url": invoice.HostedInvoiceURL,
+		"invoice_pdf":        invoice.InvoicePDF,
+		"period_start":       Date(invoice.PeriodStart),
+		"period_end":         Date(invoice.PeriodEnd),
+		"invoice_date":       Date(invoice.Created),
+		"metadata":           invoice.Metadata,
+	}
+}
+
+// InvoiceLine maps a line of a stripe invoice onto an entry of the invoice record's lines
+func InvoiceLine(line *stripe.InvoiceLineItem) map[string]any {
+	if line == nil {
+		return nil
+	}
+
+	data := map[string]any{
+		"line_id":     line.ID,
+		"type":        line.Type,
+		"description": line.Description,
+		"amount":      line.Amount,
+		"currency":    line.Currency,
+		"quantity":    line.Quantity,
+		"proration":   line.Proration,
+		"price_id":    PriceID(line.Price),
+	}
+	if line.Period != nil {
+		data["period_start"] = Date(line.Period.Start)
+		data["period_end"] = Date(line.Period.End)
+	}
+
+	return data
+}
@@ -0,0 +1,61 @@
+// Package mapping converts stripe objects into the data of their pocketbase records.
+//
+// Every converter is nil-safe: unexpanded references only carry their id, missing ones map
+// to empty values, and zero timestamps map to empty dates instead of 1970-01-01. Both the
+// webhook and the backfill write records through these converters, so a new field only
+// has to be added here.
+package mapping
+
+import (
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Date formats a unix timestamp as an ISO 8601 date in UTC, or "" for the zero timestamp
+func Date(timestamp int64) string {
+	if timestamp == 0 {
+		return ""
+	}
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+}
+
+// CustomerID returns the id of a possibly unexpanded or missing customer
+func CustomerID(customer *stripe.Customer) string {
+	if customer == nil {
+		return ""
+	}
+	return customer.ID
+}
+
+// SubscriptionID returns the id of a possibly unexpanded or missing subscription
+func SubscriptionID(subscription *stripe.Subscription) string {
+	if subscription == nil {
+		return ""
+	}
+	return subscription.ID
+}
+
+// PaymentIntentID returns the id of a possibly unexpanded or missing payment intent
+func PaymentIntentID(paymentIntent *stripe.PaymentIntent) string {
+	if paymentIntent == nil {
+		return ""
+	}
+	return paymentIntent.ID
+}
+
+// ProductID returns the id of a possibly unexpanded or missing product
+func ProductID(product *stripe.Product) string {
+	if product == nil {
+		return ""
+	}
+	return product.ID
+}
+
+// PriceID returns the id of a possibly missing price
+func PriceID(price *stripe.Price) string {
+	if price == nil {
+		return ""
+	}
+	return price.ID
+}
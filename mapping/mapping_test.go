@@ -0,0 +1,357 @@
+package mapping
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+// loadFixture decodes testdata/<name> into v the same way stripe-go decodes api responses and events
+func loadFixture(t *testing.T, name string, v any) {
+	t.Helper()
+
+	raw, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		t.Fatalf("couldn't decode %s: %v", name, err)
+	}
+}
+
+// assertData compares record data by its json encoding, so stripe's string types compare as strings
+func assertData(t *testing.T, got any, want any) {
+	t.Helper()
+
+	gotJSON, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantJSON, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("\ngot:  %s\nwant: %s", gotJSON, wantJSON)
+	}
+}
+
+func TestDate(t *testing.T) {
+	scenarios := []struct {
+		timestamp int64
+		expected  string
+	}{
+		{0, ""},
+		{1679609767, "2023-03-23T22:16:07Z"},
+	}
+
+	for _, s := range scenarios {
+		if got := Date(s.timestamp); got != s.expected {
+			t.Errorf("Date(%d) = %q, expected %q", s.timestamp, got, s.expected)
+		}
+	}
+}
+
+func TestNilObjects(t *testing.T) {
+	scenarios := map[string]map[string]any{
+		"Product":          Product(nil),
+		"Price":            Price(nil),
+		"Subscription":     Subscription(nil, nil),
+		"SubscriptionItem": SubscriptionItem("sub_123", nil),
+		"BillingDetails":   BillingDetails(nil),
+		"Customer":         Customer(nil),
+		"PaymentMethod":    PaymentMethod(nil),
+		"Invoice":          Invoice(nil),
+		"InvoiceLine":      InvoiceLine(nil),
+		"CheckoutSession":  CheckoutSession(nil),
+		"CheckoutLineItem": CheckoutLineItem(nil),
+	}
+
+	for name, data := range scenarios {
+		if data != nil {
+			t.Errorf("%s(nil) = %v, expected nil", name, data)
+		}
+	}
+
+	if id := CustomerID(nil) + SubscriptionID(nil) + PaymentIntentID(nil) + ProductID(nil) + PriceID(nil); id != "" {
+		t.Errorf("expected empty ids for nil references, got %q", id)
+	}
+}
+
+func TestProduct(t *testing.T) {
+	var product stripe.Product
+	loadFixture(t, "product.json", &product)
+
+	assertData(t, Product(&product), map[string]any{
+		"product_id":  "prod_NWjs8kKbJWmuuc",
+		"active":      true,
+		"name":        "Pro",
+		"description": "",
+		"metadata":    map[string]string{"feature.projects": "10"},
+	})
+}
+
+func TestPrice(t *testing.T) {
+	t.Run("metered with unexpanded product", func(t *testing.T) {
+		var price stripe.Price
+		loadFixture(t, "price_metered.json", &price)
+
+		assertData(t, Price(&price), map[string]any{
+			"price_id":          "price_1MoBy5LkdIwHu7ixZhnattbh",
+			"product_id":        "prod_NWjs8kKbJWmuuc",
+			"active":            true,
+			"currency":          "usd",
+			"description":       "API calls",
+			"type":              "recurring",
+			"unit_amount":       2,
+			"billing_scheme":    "per_unit",
+			"tiers_mode":        "",
+			"tiers":             []map[string]any{},
+			"lookup_key":        "",
+			"tax_behavior":      "unspecified",
+			"metadata":          map[string]string{"meter": "api_calls"},
+			"interval":          "month",
+			"interval_count":    1,
+			"trial_period_days": 0,
+			"usage_type":        "metered",
+			"aggregate_usage":   "sum",
+		})
+	})
+
+	t.Run("tiered with expanded product", func(t *testing.T) {
+		var price stripe.Price
+		loadFixture(t, "price_tiered.json", &price)
+
+		data := Price(&price)
+		if data["product_id"] != "prod_NZKdYqrwEYx6iK" {
+			t.Errorf("expected the expanded product's id, got %v", data["product_id"])
+		}
+		assertData(t, data["tiers"], []map[string]any{
+			{"up_to": 5, "unit_amount": 500, "unit_amount_decimal": 500, "flat_amount": 1000, "flat_amount_decimal": 1000},
+			{"up_to": nil, "unit_amount": 400, "unit_amount_decimal": 400, "flat_amount": 0, "flat_amount_decimal": 0},
+		})
+		assertData(t, data["transform_quantity"], map[string]any{"divide_by": 10, "round": "up"})
+		if data["trial_period_days"] != int64(14) {
+			t.Errorf("expected 14 trial days, got %v", data["trial_period_days"])
+		}
+	})
+
+	t.Run("one-time has no recurring fields", func(t *testing.T) {
+		var price stripe.Price
+		loadFixture(t, "price_one_time.json", &price)
+
+		data := Price(&price)
+		for _, key := range []string{"interval", "interval_count", "trial_period_days", "usage_type", "aggregate_usage", "transform_quantity"} {
+			if _, ok := data[key]; ok {
+				t.Errorf("expected no %s for a one-time price, got %v", key, data[key])
+			}
+		}
+	})
+}
+
+func TestSubscription(t *testing.T) {
+	var subscription stripe.Subscription
+	loadFixture(t, "subscription.json", &subscription)
+
+	// the first item is a metered add-on, so the licensed second item is the primary one
+	assertData(t, Subscription(&subscription, subscription.Items.Data), map[string]any{
+		"subscription_id":      "sub_1MowQVLkdIwHu7ixeRlqHVzs",
+		"metadata":             map[string]string{"organisation_id": "k3n8a0x2m5q7w1e"},
+		"status":               "trialing",
+		"price_id":             "price_1MowQULkdIwHu7ixspc",
+		"quantity":             3,
+		"cancel_at_period_end": true,
+		"cancel_at":            "",
+		"canceled_at":          "",
+		"current_period_start": "2023-03-23T22:16:07Z",
+		"current_period_end":   "2023-04-23T22:16:07Z",
+		"ended_at":             "",
+		"trial_start":          "2023-03-23T22:16:07Z",
+		"trial_end":            "2023-03-30T22:16:07Z",
+	})
+
+	assertData(t, SubscriptionItem(subscription.ID, subscription.Items.Data[0]), map[string]any{
+		"item_id":         "si_NcLYdDxLHxlFo7",
+		"subscription_id": "sub_1MowQVLkdIwHu7ixeRlqHVzs",
+		"price_id":        "price_1MoBy5LkdIwHu7ixZhnattbh",
+		"product_id":      "prod_NWjs8kKbJWmuuc",
+		"quantity":        0,
+		"metadata":        map[string]string{},
+		"item_created":    "2023-03-23T22:16:08Z",
+	})
+
+	// the payment method's customer isn't expanded, so its own billing address is used
+	assertData(t, BillingDetails(&subscription), map[string]any{
+		"payment_method": "card",
+		"billing_address": map[string]any{
+			"city":        "Sydney",
+			"country":     "AU",
+			"line1":       "1 George St",
+			"line2":       "",
+			"postal_code": "2000",
+			"state":       "NSW",
+		},
+	})
+
+	if id := CustomerID(subscription.Customer); id != "cus_Na6dX7aXxi11N4" {
+		t.Errorf("expected the unexpanded customer's id, got %q", id)
+	}
+}
+
+func TestSubscriptionWithoutItems(t *testing.T) {
+	var subscription stripe.Subscription
+	loadFixture(t, "subscription_minimal.json", &subscription)
+
+	data := Subscription(&subscription, subscription.Items.Data)
+	if data["price_id"] != "" || data["quantity"] != int64(0) {
+		t.Errorf("expected no primary price, got %v x %v", data["price_id"], data["quantity"])
+	}
+	for _, key := range []string{"cancel_at", "canceled_at", "current_period_start", "current_period_end", "ended_at", "trial_start", "trial_end"} {
+		if data[key] != "" {
+			t.Errorf("expected an empty %s, got %v", key, data[key])
+		}
+	}
+
+	if details := BillingDetails(&subscription); details != nil {
+		t.Errorf("expected no billing details for an unexpanded payment method, got %v", details)
+	}
+	if id := CustomerID(subscription.Customer); id != "" {
+		t.Errorf("expected no customer, got %q", id)
+	}
+}
+
+func TestCustomer(t *testing.T) {
+	var customer stripe.Customer
+	loadFixture(t, "customer.json", &customer)
+
+	assertData(t, Customer(&customer), map[string]any{
+		"stripe_customer_id": "cus_Na6dX7aXxi11N4",
+		"email":              "jenny.rosen@example.com",
+		"name":               "Jenny Rosen",
+		"phone":              "+61 2 9999 9999",
+		"address": map[string]any{
+			"city":        "Sydney",
+			"country":     "AU",
+			"line1":       "1 George St",
+			"line2":       "",
+			"postal_code": "2000",
+			"state":       "NSW",
+		},
+		"tax_exempt": "none",
+		"default_payment_method": map[string]any{
+			"id":        "pm_1MqLiJLkdIwHu7ixUEgbFdYF",
+			"type":      "card",
+			"brand":     "visa",
+			"last4":     "4242",
+			"exp_month": 8,
+			"exp_year":  2026,
+		},
+		"balance":    -500,
+		"currency":   "aud",
+		"delinquent": true,
+		"deleted":    false,
+	})
+}
+
+func TestCustomerWithoutProfile(t *testing.T) {
+	var customer stripe.Customer
+	loadFixture(t, "customer_minimal.json", &customer)
+
+	// the default payment method isn't expanded, so only its id is known
+	assertData(t, Customer(&customer), map[string]any{
+		"stripe_customer_id":     "cus_NffrFeUfNV2Hib",
+		"email":                  "",
+		"name":                   "",
+		"phone":                  "",
+		"address":                nil,
+		"tax_exempt":             "exempt",
+		"default_payment_method": map[string]any{"id": "pm_1MqLiJLkdIwHu7ixUEgbFdYF", "type": ""},
+		"balance":                0,
+		"currency":               "",
+		"delinquent":             false,
+		"deleted":                false,
+	})
+}
+
+func TestInvoice(t *testing.T) {
+	var invoice stripe.Invoice
+	loadFixture(t, "invoice.json", &invoice)
+
+	assertData(t, Invoice(&invoice), map[string]any{
+		"invoice_id":         "in_1MtHbELkdIwHu7ixl4OzzPMv",
+		"stripe_customer_id": "cus_NeZwdNtLEOXuvB",
+		"subscription_id":    "",
+		"number":             "",
+		"status":             "draft",
+		"currency":           "usd",
+		"subtotal":           1500,
+		"total":              1500,
+		"amount_due":         1500,
+		"amount_paid":        0,
+		"amount_remaining":   1500,
+		"hosted_invoice_url": "",
+		"invoice_pdf":        "",
+		"period_start":       "2023-04-04T21:41:07Z",
+		"period_end":         "2023-04-04T21:41:07Z",
+		"invoice_date":       "2023-04-04T21:41:07Z",
+		"metadata":           map[string]string{},
+	})
+
+	assertData(t, InvoiceLine(invoice.Lines.Data[0]), map[string]any{
+		"line_id":      "il_1MtHbELkdIwHu7ixlpNl0Gt5",
+		"type":         "subscription",
+		"description":  "3 × Team (at $5.00 / month)",
+		"amount":       1500,
+		"currency":     "usd",
+		"quantity":     3,
+		"proration":    false,
+		"price_id":     "price_1MowQULkdIwHu7ixspc",
+		"period_start": "2023-04-04T21:41:07Z",
+		"period_end":   "2023-05-04T21:41:07Z",
+	})
+
+	// no price and no period
+	assertData(t, InvoiceLine(invoice.Lines.Data[1]), map[string]any{
+		"line_id":     "il_1MtHbELkdIwHu7ixnoPrice",
+		"type":        "invoiceitem",
+		"description": "Manual adjustment",
+		"amount":      0,
+		"currency":    "usd",
+		"quantity":    0,
+		"proration":   false,
+		"price_id":    "",
+	})
+}
+
+func TestCheckoutSession(t *testing.T) {
+	var session stripe.CheckoutSession
+	loadFixture(t, "checkout_session.json", &session)
+
+	assertData(t, CheckoutSession(&session), map[string]any{
+		"checkout_session_id": "cs_test_a11YYufWQzNY63zpQ6QSNRQhkUpVph4WRmzW0zWJO2znZKdVujZ0N0S22u",
+		"payment_intent_id":   "pi_3MtwBwLkdIwHu7ix28a3tqPa",
+		"amount_total":        2198,
+		"currency":            "usd",
+		"metadata":            map[string]string{},
+	})
+
+	if id := SubscriptionID(session.Subscription); id != "" {
+		t.Errorf("expected no subscription on a payment session, got %q", id)
+	}
+
+	var item stripe.LineItem
+	loadFixture(t, "line_item.json", &item)
+
+	assertData(t, CheckoutLineItem(&item), map[string]any{
+		"line_id":      "li_1MtwBwLkdIwHu7ixXyBtEBf9",
+		"description":  "T-shirt",
+		"quantity":     2,
+		"amount_total": 2198,
+		"currency":     "usd",
+		"price_id":     "price_1MtwBwLkdIwHu7ixShirt",
+		"product_id":   "prod_NfHJaI9K8NJFNB",
+	})
+}
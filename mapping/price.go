@@ -0,0 +1,64 @@
+package mapping
+
+import "github.com/stripe/stripe-go/v76"
+
+// Price maps a stripe price onto the fields of its price record.
+// The recurring fields are only set for recurring prices.
+func Price(price *stripe.Price) map[string]any {
+	if price == nil {
+		return nil
+	}
+
+	data := map[string]any{
+		"price_id":       price.ID,
+		"product_id":     ProductID(price.Product),
+		"active":         price.Active,
+		"currency":       price.Currency,
+		"description":    price.Nickname,
+		"type":           price.Type,
+		"unit_amount":    price.UnitAmount,
+		"billing_scheme": price.BillingScheme,
+		"tiers_mode":     price.TiersMode,
+		"tiers":          PriceTiers(price.Tiers),
+		"lookup_key":     price.LookupKey,
+		"tax_behavior":   price.TaxBehavior,
+		"metadata":       price.Metadata,
+	}
+	if price.TransformQuantity != nil {
+		data["transform_quantity"] = map[string]any{
+			"divide_by": price.TransformQuantity.DivideBy,
+			"round":     price.TransformQuantity.Round,
+		}
+	}
+	if price.Recurring != nil {
+		data["interval"] = price.Recurring.Interval
+		data["interval_count"] = price.Recurring.IntervalCount
+		data["trial_period_days"] = price.Recurring.TrialPeriodDays
+		data["usage_type"] = price.Recurring.UsageType
+		data["aggregate_usage"] = price.Recurring.AggregateUsage
+	}
+
+	return data
+}
+
+// PriceTiers flattens the tiers of a tiered price, the last tier's up_to is nil for "inf"
+func PriceTiers(tiers []*stripe.PriceTier) []map[string]any {
+	result := make([]map[string]any, 0, len(tiers))
+	for _, tier := range tiers {
+		if tier == nil {
+			continue
+		}
+		var upTo any
+		if tier.UpTo > 0 {
+			upTo = tier.UpTo
+		}
+		result = append(result, map[string]any{
+			"up_to":               upTo,
+			"unit_amount":         tier.UnitAmount,
+			"unit_amount_decimal": tier.UnitAmountDecimal,
+			"flat_amount":         tier.FlatAmount,
+			"flat_amount_decimal": tier.FlatAmountDecimal,
+		})
+	}
+	return result
+}
@@ -0,0 +1,18 @@
+package mapping
+
+import "github.com/stripe/stripe-go/v76"
+
+// Product maps a stripe product onto the fields of its product record
+func Product(product *stripe.Product) map[string]any {
+	if product == nil {
+		return nil
+	}
+
+	return map[string]any{
+		"product_id":  product.ID,
+		"active":      product.Active,
+		"name":        product.Name,
+		"description": product.Description,
+		"metadata":    product.Metadata,
+	}
+}
@@ -0,0 +1,95 @@
+package mapping
+
+import "github.com/stripe/stripe-go/v76"
+
+// Subscription maps a stripe subscription and all of its items onto the fields of its subscription
+// record. price_id and quantity are the primary item's, kept for backwards compatibility.
+func Subscription(subscription *stripe.Subscription, items []*stripe.SubscriptionItem) map[string]any {
+	if subscription == nil {
+		return nil
+	}
+
+	priceId := ""
+	var quantity int64
+	if primary := PrimaryItem(items); primary != nil {
+		priceId = PriceID(primary.Price)
+		quantity = primary.Quantity
+	}
+
+	return map[string]any{
+		"subscription_id":      subscription.ID,
+		"metadata":             subscription.Metadata,
+		"status":               subscription.Status,
+		"price_id":             priceId,
+		"quantity":             quantity,
+		"cancel_at_period_end": subscription.CancelAtPeriodEnd,
+		"cancel_at":            Date(subscription.CancelAt),
+		"canceled_at":          Date(subscription.CanceledAt),
+		"current_period_start": Date(subscription.CurrentPeriodStart),
+		"current_period_end":   Date(subscription.CurrentPeriodEnd),
+		"ended_at":             Date(subscription.EndedAt),
+		"trial_start":          Date(subscription.TrialStart),
+		"trial_end":            Date(subscription.TrialEnd),
+	}
+}
+
+// PrimaryItem is the first item with a licensed price, metered add-ons only count when there is nothing else
+func PrimaryItem(items []*stripe.SubscriptionItem) *stripe.SubscriptionItem {
+	var first *stripe.SubscriptionItem
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		if first == nil {
+			first = item
+		}
+		if item.Price != nil && item.Price.Recurring != nil && item.Price.Recurring.UsageType == stripe.PriceRecurringUsageTypeMetered {
+			continue
+		}
+		return item
+	}
+	return first
+}
+
+// SubscriptionItem maps a stripe subscription item onto the fields of its subscription_item record
+func SubscriptionItem(subscriptionId string, item *stripe.SubscriptionItem) map[string]any {
+	if item == nil {
+		return nil
+	}
+
+	data := map[string]any{
+		"item_id":         item.ID,
+		"subscription_id": subscriptionId,
+		"price_id":        PriceID(item.Price),
+		"product_id":      "",
+		"quantity":        item.Quantity,
+		"metadata":        item.Metadata,
+		"item_created":    Date(item.Created),
+	}
+	if item.Price != nil {
+		data["product_id"] = ProductID(item.Price.Product)
+	}
+
+	return data
+}
+
+// BillingDetails returns the payment_method and billing_address user fields from the subscription's
+// default payment method, or nil when it has none or it isn't expanded. The address is the customer's
+// when the payment method's customer is expanded, otherwise the payment method's own billing address.
+func BillingDetails(subscription *stripe.Subscription) map[string]any {
+	if subscription == nil || subscription.DefaultPaymentMethod == nil || subscription.DefaultPaymentMethod.Type == "" {
+		return nil
+	}
+	paymentMethod := subscription.DefaultPaymentMethod
+
+	data := map[string]any{
+		"payment_method": paymentMethod.Type,
+	}
+	if paymentMethod.Customer != nil && paymentMethod.Customer.Address != nil {
+		data["billing_address"] = paymentMethod.Customer.Address
+	} else if paymentMethod.BillingDetails != nil && paymentMethod.BillingDetails.Address != nil {
+		data["billing_address"] = paymentMethod.BillingDetails.Address
+	}
+
+	return data
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/hook"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"github.com/stripe/stripe-go/v76"
+	checkoutSession "github.com/stripe/stripe-go/v76/checkout/session"
+
+	"pocketbase/mapping"
+)
+
+const (
+	orderPending  = "pending"
+	orderPaid     = "paid"
+	orderRefunded = "refunded"
+	orderDisputed = "disputed"
+)
+
+// OrderEvent is passed to the onOrderPaid and onOrderRevoked hooks
+type OrderEvent struct {
+	App   *pocketbase.PocketBase
+	Order *models.Record
+}
+
+// onOrderPaid is triggered once for every one-time purchase that has been paid for.
+// Bind to it in main to grant the user what they bought, the purchased prices are in
+// the order's line_items. Returning an error leaves the order unfulfilled and the
+// webhook event is retried.
+var onOrderPaid = &hook.Hook[*OrderEvent]{}
+
+// onOrderRevoked is triggered when a fulfilled order is fully refunded or a dispute on it
+// is lost. Bind to it in main to take back what onOrderPaid granted.
+var onOrderRevoked = &hook.Hook[*OrderEvent]{}
+
+// syncCheckoutOrder upserts the order of a completed payment mode checkout session
+func syncCheckoutOrder(app *pocketbase.PocketBase, session *stripe.CheckoutSession) error {
+	paymentIntentId := mapping.PaymentIntentID(session.PaymentIntent)
+
+	lineItems, err := checkoutLineItems(session.ID)
+	if err != nil {
+		return errors.New("couldn't retrieve checkout line items from stripe")
+	}
+
+	status := orderPending
+	if session.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid ||
+		session.PaymentStatus == stripe.CheckoutSessionPaymentStatusNoPaymentRequired {
+		status = orderPaid
+	}
+
+	data := mapping.CheckoutSession(session)
+	data["line_items"] = lineItems
+
+	return saveOrder(app, findOrder(app, session.ID, paymentIntentId), session.Customer, status, data)
+}
+
+// syncPaymentIntentOrder marks the order of a succeeded payment intent as paid.
+// Payment intents of invoices belong to subscriptions and are left to the invoice sync.
+func syncPaymentIntentOrder(app *pocketbase.PocketBase, paymentIntent *stripe.PaymentIntent) error {
+	if paymentIntent.Invoice != nil {
+		return nil
+	}
+
+	data := map[string]any{}
+	existingRecord := findOrder(app, "", paymentIntent.ID)
+
+	// this event usually arrives before checkout.session.completed, so the session and its
+	// line items are fetched here for the order to be fulfilled with what was bought
+	if existingRecord == nil || existingRecord.GetString("checkout_session_id") == "" {
+		session, err := paymentIntentCheckoutSession(paymentIntent.ID)
+		if err != nil {
+			return errors.New("couldn't retrieve checkout session from stripe")
+		}
+		if session != nil {
+			lineItems, err := checkoutLineItems(session.ID)
+			if err != nil {
+				return errors.New("couldn't retrieve checkout line items from stripe")
+			}
+			data = mapping.CheckoutSession(session)
+			data["line_items"] = lineItems
+		} else if existingRecord == nil {
+			data["metadata"] = paymentIntent.Metadata
+		}
+	}
+
+	data["payment_intent_id"] = paymentIntent.ID
+	data["amount_total"] = paymentIntent.AmountReceived
+	data["currency"] = paymentIntent.Currency
+
+	return saveOrder(app, existingRecord, paymentIntent.Customer, orderPaid, data)
+}
+
+// paymentIntentCheckoutSession returns the checkout session the payment intent was created by,
+// or nil when it wasn't created by a checkout
+func paymentIntentCheckoutSession(paymentIntentId string) (*stripe.CheckoutSession, error) {
+	iter := checkoutSession.List(&stripe.CheckoutSessionListParams{
+		PaymentIntent: stripe.String(paymentIntentId),
+	})
+	if iter.Next() {
+		return iter.CheckoutSession(), nil
+	}
+
+	return nil, iter.Err()
+}
+
+// findOrder looks the order up by checkout session and falls back to the payment intent,
+// since either of the two events can arrive first
+func findOrder(app *pocketbase.PocketBase, sessionId string, paymentIntentId string) *models.Record {
+	if sessionId != "" {
+		if record, err := app.Dao().FindFirstRecordByData("order", "checkout_session_id", sessionId); err == nil {
+			return record
+		}
+	}
+	if paymentIntentId != "" {
+		if record, err := app.Dao().FindFirstRecordByData("order", "payment_intent_id", paymentIntentId); err == nil {
+			return record
+		}
+	}
+	return nil
+}
+
+func saveOrder(app *pocketbase.PocketBase, existingRecord *models.Record, stripeCustomer *stripe.Customer, status string, data map[string]any) error {
+	record := existingRecord
+	if record == nil {
+		collection, err := app.Dao().FindCollectionByNameOrId("order")
+		if err != nil {
+			return errors.New("collection doesn't exist")
+		}
+		record = models.NewRecord(collection)
+	}
+
+	if stripeCustomer != nil {
+		existingCustomer, err := app.Dao().FindFirstRecordByData("customer", "stripe_customer_id", stripeCustomer.ID)
+		if err != nil {
+			return errors.New("no customer")
+		}
+		data["stripe_customer_id"] = stripeCustomer.ID
+		data["user_id"] = existingCustomer.GetString("user_id")
+		data["organisation_id"] = existingCustomer.GetString("organisation_id")
+	}
+
+	// only pending orders move forward, a paid or refunded order never goes back
+	if current := record.GetString("status"); current == "" || current == orderPending {
+		data["status"] = status
+		if status == orderPaid {
+			data["paid_at"] = types.NowDateTime()
+		}
+	}
+
+	form := forms.NewRecordUpsert(app, record)
+	form.LoadData(data)
+	if err := form.Submit(); err != nil {
+		return errors.New("couldn't submit order update")
+	}
+
+	// line items come from the checkout session, so orders without one have nothing to fulfil yet
+	if record.GetString("status") == orderPaid && !record.GetBool("fulfilled") && record.GetString("checkout_session_id") != "" {
+		return fulfilOrder(app, record)
+	}
+
+	return nil
+}
+
+// fulfilOrder runs the onOrderPaid hook and marks the order as fulfilled when it succeeds
+func fulfilOrder(app *pocketbase.PocketBase, record *models.Record) error {
+	if err := onOrderPaid.Trigger(&OrderEvent{App: app, Order: record}); err != nil {
+		return err
+	}
+
+	form := forms.NewRecordUpsert(app, record)
+	form.LoadData(map[string]any{
+		"fulfilled": true,
+	})
+	if err := form.Submit(); err != nil {
+		return errors.New("couldn't submit order update")
+	}
+
+	return nil
+}
+
+// revokeOrder moves the order to the given status and, if it was fulfilled, runs the
+// onOrderRevoked hook and clears the fulfilled flag
+func revokeOrder(app *pocketbase.PocketBase, record *models.Record, status string) error {
+	data := map[string]any{
+		"status": status,
+	}
+
+	if record.GetBool("fulfilled") {
+		if err := onOrderRevoked.Trigger(&OrderEvent{App: app, Order: record}); err != nil {
+			return err
+		}
+		data["fulfilled"] = false
+	}
+
+	form := forms.NewRecordUpsert(app, record)
+	form.LoadData(data)
+	if err := form.Submit(); err != nil {
+		return errors.New("couldn't submit order update")
+	}
+
+	return nil
+}
+
+// checkoutLineItems lists the line items of a checkout session, they aren't included in the event
+func checkoutLineItems(sessionId string) ([]map[string]any, error) {
+	lineItems := []map[string]any{}
+
+	iter := checkoutSession.ListLineItems(&stripe.CheckoutSessionListLineItemsParams{
+		Session: stripe.String(sessionId),
+	})
+	for iter.Next() {
+		lineItem := mapping.CheckoutLineItem(iter.LineItem())
+		lineItems = append(lineItems, lineItem)
+	}
+
+	return lineItems, iter.Err()
+}
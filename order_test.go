@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOrderIsFulfilledOnceItHasLineItems(t *testing.T) {
+	app := newTestApp(t)
+
+	fulfilled := 0
+	id := onOrderPaid.Add(func(e *OrderEvent) error {
+		if len(e.Order.GetString("line_items")) <= 2 {
+			t.Errorf("order fulfilled without line items: %s", e.Order.GetString("line_items"))
+		}
+		fulfilled++
+		return nil
+	})
+	t.Cleanup(func() { onOrderPaid.Remove(id) })
+
+	// a payment intent that isn't from a checkout only records the payment
+	if err := saveOrder(app, nil, nil, orderPaid, map[string]any{"payment_intent_id": "pi_test"}); err != nil {
+		t.Fatal(err)
+	}
+	if fulfilled != 0 {
+		t.Fatalf("expected an order without line items not to be fulfilled")
+	}
+
+	// the checkout session brings the line items
+	record := findOrder(app, "cs_test", "pi_test")
+	err := saveOrder(app, record, nil, orderPaid, map[string]any{
+		"checkout_session_id": "cs_test",
+		"payment_intent_id":   "pi_test",
+		"line_items":          []map[string]any{{"price_id": "price_shirt", "quantity": 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fulfilled != 1 {
+		t.Fatalf("expected the order to be fulfilled once, got %d", fulfilled)
+	}
+
+	// later events don't fulfil it again
+	if err := saveOrder(app, record, nil, orderPaid, map[string]any{"payment_intent_id": "pi_test"}); err != nil {
+		t.Fatal(err)
+	}
+	if fulfilled != 1 || !record.GetBool("fulfilled") {
+		t.Fatalf("expected the order to stay fulfilled once, got %d", fulfilled)
+	}
+}
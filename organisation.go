@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/routine"
+
+	"github.com/stripe/stripe-go/v76"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+	"github.com/stripe/stripe-go/v76/subscriptionitem"
+)
+
+// seat quantities are prorated on the next invoice instead of charged on every membership change
+const seatProration = "create_prorations"
+
+// billingOwner is who a stripe customer and its subscriptions belong to,
+// either a single user or an organisation
+type billingOwner struct {
+	userId         string
+	organisationId string
+}
+
+// customerFilter returns the customer field and value the owner's customer record is keyed by
+func (o billingOwner) customerFilter() (string, string) {
+	if o.organisationId != "" {
+		return "organisation_id", o.organisationId
+	}
+	return "user_id", o.userId
+}
+
+// requestBillingOwner returns the organisation as the owner when an organisation id is given,
+// which only the organisation's admins may bill for, and the user otherwise
+func requestBillingOwner(app *pocketbase.PocketBase, user *models.Record, organisationId string) (billingOwner, error) {
+	if organisationId == "" {
+		return billingOwner{userId: user.Id}, nil
+	}
+
+	if !isOrganisationAdmin(user, organisationId) {
+		return billingOwner{}, errors.New("only organisation admins can manage billing")
+	}
+	if _, err := app.Dao().FindRecordById("organisation", organisationId); err != nil {
+		return billingOwner{}, errors.New("organisation not found")
+	}
+
+	return billingOwner{organisationId: organisationId}, nil
+}
+
+func isOrganisationAdmin(user *models.Record, organisationId string) bool {
+	return organisationId != "" &&
+		user.GetString("organisation_id") == organisationId &&
+		user.GetString("organisation_role") == "Admin"
+}
+
+// userSubscriptions returns the subscriptions giving the user access, their own and
+// the ones of the organisation they are a member of
+func userSubscriptions(app *pocketbase.PocketBase, user *models.Record) ([]*models.Record, error) {
+	expr := dbx.Or(dbx.HashExp{"user_id": user.Id})
+	if organisationId := user.GetString("organisation_id"); organisationId != "" {
+		expr = dbx.Or(dbx.HashExp{"user_id": user.Id}, dbx.HashExp{"organisation_id": organisationId})
+	}
+
+	return app.Dao().FindRecordsByExpr("subscription", expr)
+}
+
+// userPaidOrders returns the paid orders granting the user features, their own and
+// the ones bought through the organisation they are a member of
+func userPaidOrders(app *pocketbase.PocketBase, user *models.Record) ([]*models.Record, error) {
+	expr := dbx.Or(dbx.HashExp{"user_id": user.Id})
+	if organisationId := user.GetString("organisation_id"); organisationId != "" {
+		expr = dbx.Or(dbx.HashExp{"user_id": user.Id}, dbx.HashExp{"organisation_id": organisationId})
+	}
+
+	return app.Dao().FindRecordsByExpr("order", dbx.HashExp{"status": orderPaid}, expr)
+}
+
+func organisationMemberCount(app *pocketbase.PocketBase, organisationId string) (int64, error) {
+	var count int64
+	err := app.Dao().RecordQuery("user").
+		Select("count(*)").
+		AndWhere(dbx.HashExp{"organisation_id": organisationId}).
+		Row(&count)
+
+	return count, err
+}
+
+// isSeatPrice reports whether the price is billed per organisation member,
+// set with seat_based: "true" in the metadata of the price or its product
+func isSeatPrice(app *pocketbase.PocketBase, priceId string) bool {
+	priceRecord, err := app.Dao().FindFirstRecordByData("price", "price_id", priceId)
+	if err != nil {
+		return false
+	}
+	if hasMetadataFlag(priceRecord, "seat_based") {
+		return true
+	}
+
+	productRecord, err := app.Dao().FindFirstRecordByData("product", "product_id", priceRecord.GetString("product_id"))
+	if err != nil {
+		return false
+	}
+
+	return hasMetadataFlag(productRecord, "seat_based")
+}
+
+func hasMetadataFlag(record *models.Record, key string) bool {
+	metadata := map[string]string{}
+	if err := record.UnmarshalJSONField("metadata", &metadata); err != nil {
+		return false
+	}
+	return metadata[key] == "true"
+}
+
+// applySeats sets the quantity of the cart's seat prices to the organisation's member count
+func applySeats(app *pocketbase.PocketBase, cart *checkoutCart, organisationId string) error {
+	seats, err := organisationMemberCount(app, organisationId)
+	if err != nil {
+		return err
+	}
+
+	for _, lineItem := range cart.lineItems {
+		if lineItem.Quantity == nil || !isSeatPrice(app, *lineItem.Price) {
+			continue
+		}
+		lineItem.Quantity = stripe.Int64(max(seats, 1))
+		lineItem.AdjustableQuantity = nil
+	}
+
+	return nil
+}
+
+// syncOrganisationSeats updates the seat items of the organisation's live subscriptions in stripe
+// to the current member count, and the local records with them
+func syncOrganisationSeats(app *pocketbase.PocketBase, organisationId string) error {
+	seats, err := organisationMemberCount(app, organisationId)
+	if err != nil {
+		return err
+	}
+	seats = max(seats, 1)
+
+	records, err := app.Dao().FindRecordsByFilter(
+		"subscription",
+		"organisation_id = {:organisation} && (status = 'active' || status = 'trialing' || status = 'past_due')",
+		"",
+		0,
+		0,
+		dbx.Params{"organisation": organisationId},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		subscription, err := stripeSubscription.Get(record.GetString("subscription_id"), nil)
+		if err != nil {
+			return err
+		}
+
+		items, err := subscriptionItems(subscription)
+		if err != nil {
+			return err
+		}
+
+		updated := false
+		for _, item := range items {
+			if item.Price == nil || item.Quantity == seats || !isSeatPrice(app, item.Price.ID) {
+				continue
+			}
+			if _, err := subscriptionitem.Update(item.ID, &stripe.SubscriptionItemParams{
+				Quantity:          stripe.Int64(seats),
+				ProrationBehavior: stripe.String(seatProration),
+			}); err != nil {
+				return err
+			}
+			updated = true
+		}
+		if !updated {
+			continue
+		}
+
+		latest, err := stripeSubscription.Get(subscription.ID, nil)
+		if err != nil {
+			return err
+		}
+		if _, _, err := upsertSubscription(app, record, latest, billingOwner{organisationId: organisationId}, noEvent, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// registerOrganisationHooks keeps seat quantities in sync when users join or leave an organisation
+func registerOrganisationHooks(app *pocketbase.PocketBase) {
+	resync := func(organisationIds ...string) {
+		for _, organisationId := range organisationIds {
+			if organisationId == "" {
+				continue
+			}
+			organisationId := organisationId
+			routine.FireAndForget(func() {
+				if err := syncOrganisationSeats(app, organisationId); err != nil {
+					app.Logger().Error("organisation seat sync failed", "organisation", organisationId, "error", err)
+				}
+			})
+		}
+	}
+
+	app.OnModelAfterCreate("user").Add(func(e *core.ModelEvent) error {
+		resync(e.Model.(*models.Record).GetString("organisation_id"))
+		return nil
+	})
+	app.OnModelAfterUpdate("user").Add(func(e *core.ModelEvent) error {
+		record := e.Model.(*models.Record)
+		before := record.OriginalCopy().GetString("organisation_id")
+		after := record.GetString("organisation_id")
+		if before != after {
+			resync(before, after)
+		}
+		return nil
+	})
+	app.OnModelAfterDelete("user").Add(func(e *core.ModelEvent) error {
+		resync(e.Model.(*models.Record).GetString("organisation_id"))
+		return nil
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/tokens"
+)
+
+func TestSignUpCantSetMembershipOrBilling(t *testing.T) {
+	app := newTestApp(t)
+	router, err := apis.InitApi(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := `"username": "member", "password": "12345678", "passwordConfirm": "12345678", "displayName": "Member", "lastSeen": "2024-01-01 00:00:00.000Z", "role": "User"`
+	scenarios := []struct {
+		name     string
+		extra    string
+		expected int
+	}{
+		{"plain sign-up", ``, http.StatusOK},
+		{"organisation", `, "organisation_id": "org1"`, http.StatusBadRequest},
+		{"organisation role", `, "organisation_role": "Admin"`, http.StatusBadRequest},
+		{"plan", `, "plan": "prod_pro"`, http.StatusBadRequest},
+		{"subscription status", `, "subscription_status": "active"`, http.StatusBadRequest},
+		{"entitlements", `, "entitlements": ["export"]`, http.StatusBadRequest},
+	}
+
+	for _, s := range scenarios {
+		body := strings.NewReader("{" + base + s.extra + "}")
+		req := httptest.NewRequest(http.MethodPost, "/api/collections/user/records", body)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != s.expected {
+			t.Errorf("%s: expected %d, got %d %s", s.name, s.expected, rec.Code, rec.Body.String())
+		}
+
+		// free the username for the next scenario
+		if rec.Code == http.StatusOK {
+			record, err := app.Dao().FindAuthRecordByUsername("user", "member")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := app.Dao().DeleteRecord(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestOrganisationAdminsSeeOrganisationBilling(t *testing.T) {
+	app := newTestApp(t)
+	router, err := apis.InitApi(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newUser := func(username string, organisationId string, role string) string {
+		user := createTestRecord(t, app, "user", map[string]any{
+			"username":          username,
+			"displayName":       username,
+			"lastSeen":          "2024-01-01 00:00:00.000Z",
+			"role":              "User",
+			"organisation_id":   organisationId,
+			"organisation_role": role,
+		})
+		token, err := tokens.NewRecordAuthToken(app, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	admin := newUser("admin", "org1", "Admin")
+	member := newUser("member", "org1", "Member")
+	outsider := newUser("outsider", "org2", "Admin")
+
+	createTestRecord(t, app, "invoice", map[string]any{"invoice_id": "in_org", "organisation_id": "org1"})
+	createTestRecord(t, app, "order", map[string]any{"checkout_session_id": "cs_org", "organisation_id": "org1"})
+
+	scenarios := []struct {
+		name     string
+		token    string
+		expected int
+	}{
+		{"organisation admin", admin, 1},
+		{"organisation member", member, 0},
+		{"admin of another organisation", outsider, 0},
+	}
+
+	for _, collection := range []string{"invoice", "order"} {
+		for _, s := range scenarios {
+			req := httptest.NewRequest(http.MethodGet, "/api/collections/"+collection+"/records", nil)
+			req.Header.Set("Authorization", s.token)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			var result struct {
+				TotalItems int `json:"totalItems"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.TotalItems != s.expected {
+				t.Errorf("%s %s: expected %d records, got %d", collection, s.name, s.expected, result.TotalItems)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// redirectAllowlist holds the patterns that client supplied success, cancel and return urls must match.
+// A pattern is an origin optionally followed by a path, e.g. "https://app.example.com/billing/*".
+// The host may use wildcards ("https://*.example.com"), a path ending in "*" matches everything
+// below it, and a pattern without a path allows any path on that origin.
+type redirectAllowlist []*url.URL
+
+// loadRedirectAllowlist reads the comma separated patterns from STRIPE_REDIRECT_ALLOWLIST
+func loadRedirectAllowlist() redirectAllowlist {
+	allowlist := redirectAllowlist{}
+	for _, pattern := range strings.Split(os.Getenv("STRIPE_REDIRECT_ALLOWLIST"), ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		parsed, err := url.Parse(pattern)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			continue
+		}
+		allowlist = append(allowlist, parsed)
+	}
+	return allowlist
+}
+
+// resolve returns the requested url when it is allowed, or the fallback when nothing was requested.
+// The {CHECKOUT_SESSION_ID} placeholder is left for stripe to fill in.
+func (a redirectAllowlist) resolve(name string, requested string, fallback string) (string, error) {
+	if requested == "" {
+		return fallback, nil
+	}
+
+	parsed, err := url.Parse(requested)
+	if err != nil || !a.allows(parsed) {
+		return "", fmt.Errorf("%s is not allowed", name)
+	}
+
+	return requested, nil
+}
+
+func (a redirectAllowlist) allows(target *url.URL) bool {
+	// ".." segments could climb out of an allowed path once the browser resolves them
+	if target.Scheme == "" || target.Host == "" || target.User != nil || strings.Contains(target.Path, "..") {
+		return false
+	}
+
+	for _, pattern := range a {
+		if !strings.EqualFold(pattern.Scheme, target.Scheme) {
+			continue
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern.Host), strings.ToLower(target.Host)); !ok {
+			continue
+		}
+
+		switch {
+		case pattern.Path == "" || pattern.Path == "/*":
+			return true
+		case strings.HasSuffix(pattern.Path, "*"):
+			if strings.HasPrefix(target.Path, strings.TrimSuffix(pattern.Path, "*")) {
+				return true
+			}
+		case pattern.Path == target.Path:
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/spf13/cobra"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/price"
+	"github.com/stripe/stripe-go/v76/product"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+// syncCounts tallies what a sync did to one collection
+type syncCounts struct {
+	created   int
+	updated   int
+	unchanged int
+	orphaned  int
+	skipped   int
+}
+
+func (c *syncCounts) add(result string) {
+	switch result {
+	case syncCreated:
+		c.created++
+	case syncUpdated:
+		c.updated++
+	default:
+		c.unchanged++
+	}
+}
+
+func (c syncCounts) String() string {
+	s := fmt.Sprintf("%d created, %d updated, %d unchanged, %d orphaned", c.created, c.updated, c.unchanged, c.orphaned)
+	if c.skipped > 0 {
+		s += fmt.Sprintf(", %d skipped", c.skipped)
+	}
+	return s
+}
+
+// newStripeCommand registers the `stripe` console command and its subcommands
+func newStripeCommand(app *pocketbase.PocketBase) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "stripe",
+		Short: "Stripe helpers",
+	}
+
+	var dryRun bool
+	syncCommand := &cobra.Command{
+		Use:   "sync",
+		Short: "Backfills products, prices and subscriptions from the stripe api",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runStripeSync(app, cmd.OutOrStdout(), dryRun)
+		},
+	}
+	syncCommand.Flags().BoolVar(&dryRun, "dry-run", false, "print what would change without writing anything")
+
+	entitlementsCommand := &cobra.Command{
+		Use:   "entitlements",
+		Short: "Rebuilds every user's entitlements, e.g. after changing feature metadata in stripe",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return refreshAllEntitlements(app, cmd.OutOrStdout())
+		},
+	}
+
+	command.AddCommand(syncCommand, entitlementsCommand)
+
+	return command
+}
+
+// runStripeSync pages through the stripe catalog and subscriptions and upserts them with
+// the same mapping the webhook uses. Records that no longer exist in stripe are reported as orphaned.
+func runStripeSync(app *pocketbase.PocketBase, out io.Writer, dryRun bool) error {
+	report := func(collection string, id string, result string, changed []string) {
+		if !dryRun || result == syncUnchanged {
+			return
+		}
+		if result == syncCreated {
+			fmt.Fprintf(out, "would create %s %s\n", collection, id)
+		} else {
+			fmt.Fprintf(out, "would update %s %s (%s)\n", collection, id, strings.Join(changed, ", "))
+		}
+	}
+
+	// products
+	products := syncCounts{}
+	seenProducts := map[string]bool{}
+	productIter := product.List(&stripe.ProductListParams{})
+	for productIter.Next() {
+		stripeProduct := productIter.Product()
+		seenProducts[stripeProduct.ID] = true
+
+		result, changed, err := syncProduct(app, stripeProduct, dryRun)
+		if err != nil {
+			return fmt.Errorf("product %s: %w", stripeProduct.ID, err)
+		}
+		products.add(result)
+		report("product", stripeProduct.ID, result, changed)
+	}
+	if err := productIter.Err(); err != nil {
+		return err
+	}
+
+	// prices
+	prices := syncCounts{}
+	seenPrices := map[string]bool{}
+	priceParams := &stripe.PriceListParams{}
+	priceParams.AddExpand("data.tiers")
+	priceIter := price.List(priceParams)
+	for priceIter.Next() {
+		stripePrice := priceIter.Price()
+		seenPrices[stripePrice.ID] = true
+
+		result, changed, err := syncPrice(app, stripePrice, dryRun)
+		if err != nil {
+			return fmt.Errorf("price %s: %w", stripePrice.ID, err)
+		}
+		prices.add(result)
+		report("price", stripePrice.ID, result, changed)
+	}
+	if err := priceIter.Err(); err != nil {
+		return err
+	}
+
+	// subscriptions
+	subscriptions := syncCounts{}
+	seenSubscriptions := map[string]bool{}
+	subscriptionIter := stripeSubscription.List(&stripe.SubscriptionListParams{
+		Status: stripe.String("all"),
+	})
+	for subscriptionIter.Next() {
+		subscription := subscriptionIter.Subscription()
+		seenSubscriptions[subscription.ID] = true
+
+		owner, err := subscriptionOwner(app, subscription)
+		if err != nil {
+			subscriptions.skipped++
+			fmt.Fprintf(out, "skipped subscription %s: %v\n", subscription.ID, err)
+			continue
+		}
+
+		existingRecord, err := app.Dao().FindFirstRecordByData("subscription", "subscription_id", subscription.ID)
+		if err != nil {
+			existingRecord = nil
+		}
+
+		result, changed, err := upsertSubscription(app, existingRecord, subscription, owner, noEvent, dryRun)
+		if err != nil {
+			return fmt.Errorf("subscription %s: %w", subscription.ID, err)
+		}
+		subscriptions.add(result)
+		report("subscription", subscription.ID, result, changed)
+	}
+	if err := subscriptionIter.Err(); err != nil {
+		return err
+	}
+
+	var err error
+	if products.orphaned, err = reportOrphans(app, out, "product", "product_id", seenProducts); err != nil {
+		return err
+	}
+	if prices.orphaned, err = reportOrphans(app, out, "price", "price_id", seenPrices); err != nil {
+		return err
+	}
+	if subscriptions.orphaned, err = reportOrphans(app, out, "subscription", "subscription_id", seenSubscriptions); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "product: %s\n", products)
+	fmt.Fprintf(out, "price: %s\n", prices)
+	fmt.Fprintf(out, "subscription: %s\n", subscriptions)
+
+	return nil
+}
+
+// reportOrphans prints and counts the records whose stripe id wasn't returned by the api.
+// Records already marked as deleted aren't orphans.
+func reportOrphans(app *pocketbase.PocketBase, out io.Writer, collection string, idField string, seen map[string]bool) (int, error) {
+	records, err := app.Dao().FindRecordsByExpr(collection)
+	if err != nil {
+		return 0, err
+	}
+
+	orphaned := 0
+	for _, record := range records {
+		if seen[record.GetString(idField)] || record.GetBool("deleted") {
+			continue
+		}
+		orphaned++
+		fmt.Fprintf(out, "orphaned %s %s\n", collection, record.GetString(idField))
+	}
+
+	return orphaned, nil
+}
+
+// refreshAllEntitlements rebuilds the user_entitlement records of every user
+func refreshAllEntitlements(app *pocketbase.PocketBase, out io.Writer) error {
+	users, err := app.Dao().FindRecordsByExpr("user")
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if err := refreshEntitlements(app, user.Id); err != nil {
+			return fmt.Errorf("user %s: %w", user.Id, err)
+		}
+	}
+	fmt.Fprintf(out, "refreshed the entitlements of %d users\n", len(users))
+
+	return nil
+}
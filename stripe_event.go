@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+const (
+	stripeEventPending   = "pending"
+	stripeEventProcessed = "processed"
+	stripeEventFailed    = "failed"
+	stripeEventDead      = "dead"
+	stripeEventIgnored   = "ignored"
+)
+
+// recordStripeEvent queues a verified delivery in the stripe_event collection.
+// It returns false when the event id was already received and shouldn't be queued again.
+func recordStripeEvent(app *pocketbase.PocketBase, event stripe.Event, payload []byte) (*models.Record, bool, error) {
+	existingRecord, err := app.Dao().FindFirstRecordByData("stripe_event", "event_id", event.ID)
+	if err == nil && existingRecord != nil {
+		return existingRecord, false, nil
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("stripe_event")
+	if err != nil {
+		return nil, false, err
+	}
+
+	record := models.NewRecord(collection)
+	form := forms.NewRecordUpsert(app, record)
+	form.LoadData(map[string]any{
+		"event_id":    event.ID,
+		"type":        event.Type,
+		"payload":     types.JsonRaw(payload),
+		"status":      stripeEventPending,
+		"attempts":    0,
+		"received_at": types.NowDateTime(),
+	})
+
+	if err := form.Submit(); err != nil {
+		// a concurrent delivery of the same event won the unique index
+		if duplicate, _ := app.Dao().FindFirstRecordByData("stripe_event", "event_id", event.ID); duplicate != nil {
+			return duplicate, false, nil
+		}
+		return nil, false, err
+	}
+
+	return record, true, nil
+}
+
+// requeueStripeEvent puts a failed or dead event back on the queue with a fresh set of attempts
+func requeueStripeEvent(app *pocketbase.PocketBase, record *models.Record) error {
+	form := forms.NewRecordUpsert(app, record)
+	form.LoadData(map[string]any{
+		"status":          stripeEventPending,
+		"attempts":        0,
+		"next_attempt_at": "",
+		"error":           "",
+	})
+
+	return form.Submit()
+}
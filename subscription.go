@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+
+	"github.com/stripe/stripe-go/v76"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+	"github.com/stripe/stripe-go/v76/subscriptionitem"
+
+	"pocketbase/mapping"
+)
+
+// syncSubscription upserts the subscription record from a stripe subscription.
+// eventCreated is the timestamp of the stripe event the data came from: records already
+// written from a newer event are left alone, and when the order can't be told apart the
+// subscription is re-fetched from the stripe api instead of trusting the payload.
+func syncSubscription(app *pocketbase.PocketBase, subscription *stripe.Subscription, eventCreated int64) error {
+	existingRecord, err := app.Dao().FindFirstRecordByData("subscription", "subscription_id", subscription.ID)
+	if err != nil {
+		existingRecord = nil
+	}
+
+	refetch := subscription.Items == nil // not expanded, e.g. on a checkout session
+	if existingRecord != nil {
+		lastEventAt := int64(existingRecord.GetInt("last_event_at"))
+		if eventCreated < lastEventAt {
+			return nil
+		}
+		if eventCreated == lastEventAt {
+			refetch = true
+		}
+	}
+
+	if refetch {
+		params := &stripe.SubscriptionParams{}
+		params.AddExpand("default_payment_method")
+		latest, err := stripeSubscription.Get(subscription.ID, params)
+		if err != nil {
+			return errors.New("couldn't retrieve subscription from stripe")
+		}
+		subscription = latest
+	}
+
+	//Get customer's owner from mapping table in order to update users billing address and payment method
+	owner, err := subscriptionOwner(app, subscription)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := upsertSubscription(app, existingRecord, subscription, owner, eventCreated, false); err != nil {
+		return err
+	}
+
+	//Update User Details, organisation subscriptions have no single user to update
+	if billingDetails := mapping.BillingDetails(subscription); owner.userId != "" && billingDetails != nil {
+		existingUserRecord, err := app.Dao().FindFirstRecordByData("user", "id", owner.userId)
+		if err != nil {
+			return errors.New("couldn't find user")
+		}
+		var userForm = forms.NewRecordUpsert(app, existingUserRecord)
+
+		userForm.LoadData(billingDetails)
+
+		// validate and submit (internally it calls app.Dao().SaveRecord(record) in a transaction)
+		if err := userForm.Submit(); err != nil {
+			return errors.New("couldn't submit user update")
+		}
+	}
+
+	return nil
+}
+
+// subscriptionOwner returns the user or organisation owning the subscription's customer
+func subscriptionOwner(app *pocketbase.PocketBase, subscription *stripe.Subscription) (billingOwner, error) {
+	customerId := mapping.CustomerID(subscription.Customer)
+	if customerId == "" {
+		return billingOwner{}, errors.New("subscription has no customer")
+	}
+	existingCustomer, err := app.Dao().FindFirstRecordByData("customer", "stripe_customer_id", customerId)
+	if err != nil {
+		return billingOwner{}, errors.New("no customer")
+	}
+
+	return billingOwner{
+		userId:         existingCustomer.GetString("user_id"),
+		organisationId: existingCustomer.GetString("organisation_id"),
+	}, nil
+}
+
+// upsertSubscription writes the stripe subscription onto the existing record, or a new one, and
+// syncs all of its items to the subscription_item collection. The record keeps the primary
+// item's price and quantity for backwards compatibility.
+// lastEventAt is the stripe event's timestamp, or noEvent for a subscription fetched from the api.
+func upsertSubscription(app *pocketbase.PocketBase, existingRecord *models.Record, subscription *stripe.Subscription, owner billingOwner, lastEventAt int64, dryRun bool) (string, []string, error) {
+	items, err := subscriptionItems(subscription)
+	if err != nil {
+		return "", nil, err
+	}
+
+	data := mapping.Subscription(subscription, items)
+	data["user_id"] = owner.userId
+	data["organisation_id"] = owner.organisationId
+	setSyncTimestamp(data, lastEventAt)
+
+	// items first, so hooks on the subscription record already see them
+	if !dryRun {
+		if err := syncSubscriptionItems(app, subscription.ID, items); err != nil {
+			return "", nil, err
+		}
+	}
+
+	result, changed, err := saveRecordData(app, "subscription", existingRecord, data, dryRun)
+	if err != nil {
+		return "", nil, errors.New("couldn't submit subscription update")
+	}
+
+	return result, changed, nil
+}
+
+// subscriptionItems returns every item of the subscription, paging through the items
+// when stripe didn't include them all
+func subscriptionItems(subscription *stripe.Subscription) ([]*stripe.SubscriptionItem, error) {
+	if subscription.Items != nil && !subscription.Items.HasMore {
+		return subscription.Items.Data, nil
+	}
+
+	items := []*stripe.SubscriptionItem{}
+	iter := subscriptionitem.List(&stripe.SubscriptionItemListParams{
+		Subscription: stripe.String(subscription.ID),
+	})
+	for iter.Next() {
+		items = append(items, iter.SubscriptionItem())
+	}
+
+	return items, iter.Err()
+}
+
+// subscriptionPriceIds returns the prices of all the subscription record's items, or its
+// primary price for records that haven't been synced with their items yet
+func subscriptionPriceIds(app *pocketbase.PocketBase, record *models.Record) []string {
+	items, err := app.Dao().FindRecordsByExpr("subscription_item", dbx.HashExp{"subscription_id": record.GetString("subscription_id")})
+	if err != nil || len(items) == 0 {
+		return []string{record.GetString("price_id")}
+	}
+
+	priceIds := make([]string, 0, len(items))
+	for _, item := range items {
+		priceIds = append(priceIds, item.GetString("price_id"))
+	}
+	return priceIds
+}
+
+// syncSubscriptionItems upserts the subscription's items and deletes the ones it no longer has
+func syncSubscriptionItems(app *pocketbase.PocketBase, subscriptionId string, items []*stripe.SubscriptionItem) error {
+	existingRecords, err := app.Dao().FindRecordsByExpr("subscription_item", dbx.HashExp{"subscription_id": subscriptionId})
+	if err != nil {
+		return err
+	}
+	existing := map[string]*models.Record{}
+	for _, record := range existingRecords {
+		existing[record.GetString("item_id")] = record
+	}
+
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		data := mapping.SubscriptionItem(subscriptionId, item)
+		if _, _, err := saveRecordData(app, "subscription_item", existing[item.ID], data, false); err != nil {
+			return errors.New("couldn't submit subscription item update")
+		}
+		delete(existing, item.ID)
+	}
+
+	for _, record := range existing {
+		if err := app.Dao().DeleteRecord(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
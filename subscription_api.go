@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v5"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/invoice"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+
+	"pocketbase/mapping"
+)
+
+// plan changes are invoiced straight away so upgrades are paid for up front
+const planChangeProration = "always_invoice"
+
+// ownedSubscription is a subscription the requesting user is allowed to manage
+type ownedSubscription struct {
+	user   *models.Record
+	owner  billingOwner
+	record *models.Record
+	stripe *stripe.Subscription
+}
+
+// requestUser resolves the auth record from the Authorization header, reusing the one
+// pocketbase's auth middleware already loaded when there is one
+func requestUser(app *pocketbase.PocketBase, c echo.Context) (*models.Record, error) {
+	if user, ok := c.Get(apis.ContextAuthRecordKey).(*models.Record); ok && user != nil {
+		return user, nil
+	}
+
+	token := c.Request().Header.Get("Authorization")
+	return app.Dao().FindAuthRecordByToken(token, app.Settings().RecordAuthToken.Secret)
+}
+
+// findOwnedSubscription loads the subscription from the :id path param and checks that it
+// belongs to the requesting user, or to the organisation they are an admin of, both in the
+// subscription collection and in stripe through the owner's customer record
+func findOwnedSubscription(app *pocketbase.PocketBase, c echo.Context) (*ownedSubscription, error) {
+	user, err := requestUser(app, c)
+	if err != nil {
+		return nil, errors.New("Could not get user")
+	}
+
+	record, err := app.Dao().FindFirstRecordByData("subscription", "subscription_id", c.PathParam("id"))
+	if err != nil {
+		return nil, errors.New("subscription not found")
+	}
+
+	owner := billingOwner{userId: user.Id}
+	if organisationId := record.GetString("organisation_id"); organisationId != "" {
+		if !isOrganisationAdmin(user, organisationId) {
+			return nil, errors.New("subscription not found")
+		}
+		owner = billingOwner{organisationId: organisationId}
+	} else if record.GetString("user_id") != user.Id {
+		return nil, errors.New("subscription not found")
+	}
+
+	customerRecord, err := activeCustomer(app, owner)
+	if err != nil {
+		return nil, errors.New("subscription not found")
+	}
+
+	subscription, err := stripeSubscription.Get(record.GetString("subscription_id"), nil)
+	if err != nil || subscription.Customer == nil || subscription.Customer.ID != customerRecord.GetString("stripe_customer_id") {
+		return nil, errors.New("subscription not found")
+	}
+
+	return &ownedSubscription{user: user, owner: owner, record: record, stripe: subscription}, nil
+}
+
+// saveManagedSubscription writes the subscription returned by stripe to the local record
+// straight away instead of waiting for the webhook
+func saveManagedSubscription(app *pocketbase.PocketBase, c echo.Context, owned *ownedSubscription, subscription *stripe.Subscription) error {
+	if _, _, err := upsertSubscription(app, owned.record, subscription, owned.owner, noEvent, false); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"failure": err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, owned.record)
+}
+
+// listSubscriptionsHandler returns the subscriptions giving the requesting user access,
+// including the ones of their organisation
+func listSubscriptionsHandler(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := requestUser(app, c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "Could not get user"})
+		}
+
+		records, err := userSubscriptions(app, user)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "Could not get subscriptions"})
+		}
+
+		return c.JSON(http.StatusOK, records)
+	}
+}
+
+// cancelSubscriptionHandler cancels at the end of the current period, or right away
+// when the body has "immediately": true
+func cancelSubscriptionHandler(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owned, err := findOwnedSubscription(app, c)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"failure": err.Error()})
+		}
+
+		var data struct {
+			Immediately bool `json:"immediately"`
+		}
+		payload, _ := io.ReadAll(c.Request().Body)
+		json.Unmarshal(payload, &data)
+
+		var subscription *stripe.Subscription
+		if data.Immediately {
+			subscription, err = stripeSubscription.Cancel(owned.stripe.ID, nil)
+		} else {
+			subscription, err = stripeSubscription.Update(owned.stripe.ID, &stripe.SubscriptionParams{
+				CancelAtPeriodEnd: stripe.Bool(true),
+			})
+		}
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "Could not cancel subscription"})
+		}
+
+		return saveManagedSubscription(app, c, owned, subscription)
+	}
+}
+
+// resumeSubscriptionHandler undoes a pending cancellation at period end
+func resumeSubscriptionHandler(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owned, err := findOwnedSubscription(app, c)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"failure": err.Error()})
+		}
+
+		if owned.stripe.Status == stripe.SubscriptionStatusCanceled || !owned.stripe.CancelAtPeriodEnd {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "subscription has no pending cancellation"})
+		}
+
+		subscription, err := stripeSubscription.Update(owned.stripe.ID, &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(false),
+		})
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "Could not resume subscription"})
+		}
+
+		return saveManagedSubscription(app, c, owned, subscription)
+	}
+}
+
+// planChange is the body of the change plan and proration preview endpoints
+type planChange struct {
+	PriceId  string `json:"price_id"`
+	Quantity int64  `json:"quantity"`
+	// required when the subscription has more than one item
+	ItemId string `json:"item_id"`
+	// the proration_date returned by the preview, so the change is charged exactly as previewed
+	ProrationDate int64 `json:"proration_date"`
+
+	metered bool
+}
+
+// quantity is left out for metered prices, they are billed on usage and stripe rejects a quantity
+func (p *planChange) quantity() *int64 {
+	if p.metered {
+		return nil
+	}
+	return stripe.Int64(p.Quantity)
+}
+
+// resolvePlanChange validates the target price against the synced catalog and
+// picks the subscription item that is being switched
+func resolvePlanChange(app *pocketbase.PocketBase, c echo.Context, owned *ownedSubscription) (*planChange, *stripe.SubscriptionItem, error) {
+	change := &planChange{}
+	payload, _ := io.ReadAll(c.Request().Body)
+	json.Unmarshal(payload, change)
+
+	priceRecord, err := app.Dao().FindFirstRecordByData("price", "price_id", change.PriceId)
+	if err != nil || !priceRecord.GetBool("active") || priceRecord.GetString("type") != "recurring" {
+		return nil, nil, errors.New("price is not available")
+	}
+	productRecord, err := app.Dao().FindFirstRecordByData("product", "product_id", priceRecord.GetString("product_id"))
+	if err != nil || !productRecord.GetBool("active") {
+		return nil, nil, errors.New("price is not available")
+	}
+
+	if owned.stripe.Items == nil || len(owned.stripe.Items.Data) == 0 {
+		return nil, nil, errors.New("subscription has no items")
+	}
+
+	var item *stripe.SubscriptionItem
+	if change.ItemId == "" {
+		if len(owned.stripe.Items.Data) > 1 {
+			return nil, nil, errors.New("item_id is required for subscriptions with several items")
+		}
+		item = owned.stripe.Items.Data[0]
+	} else {
+		for _, candidate := range owned.stripe.Items.Data {
+			if candidate.ID == change.ItemId {
+				item = candidate
+			}
+		}
+		if item == nil {
+			return nil, nil, errors.New("subscription item not found")
+		}
+	}
+
+	change.metered = priceRecord.GetString("usage_type") == "metered"
+	switch {
+	case owned.owner.organisationId != "" && isSeatPrice(app, change.PriceId):
+		// seats always follow the member count, whatever the client sends
+		seats, err := organisationMemberCount(app, owned.owner.organisationId)
+		if err != nil {
+			return nil, nil, errors.New("Could not count organisation members")
+		}
+		change.Quantity = max(seats, 1)
+	case change.Quantity < 1:
+		change.Quantity = max(item.Quantity, 1)
+	}
+
+	return change, item, nil
+}
+
+// changePlanHandler switches an item of the subscription to another price, prorating the difference
+func changePlanHandler(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owned, err := findOwnedSubscription(app, c)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"failure": err.Error()})
+		}
+
+		change, item, err := resolvePlanChange(app, c, owned)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": err.Error()})
+		}
+
+		params := &stripe.SubscriptionParams{
+			Items: []*stripe.SubscriptionItemsParams{
+				{
+					ID:       stripe.String(item.ID),
+					Price:    stripe.String(change.PriceId),
+					Quantity: change.quantity(),
+				},
+			},
+			ProrationBehavior: stripe.String(planChangeProration),
+		}
+		if change.ProrationDate > 0 {
+			params.ProrationDate = stripe.Int64(change.ProrationDate)
+		}
+
+		subscription, err := stripeSubscription.Update(owned.stripe.ID, params)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "Could not change plan"})
+		}
+
+		return saveManagedSubscription(app, c, owned, subscription)
+	}
+}
+
+// prorationLine is one line of the upcoming invoice returned by the preview
+type prorationLine struct {
+	Description string `json:"description"`
+	Amount      int64  `json:"amount"`
+	Quantity    int64  `json:"quantity"`
+	PriceId     string `json:"price_id"`
+	PeriodStart string `json:"period_start"`
+	PeriodEnd   string `json:"period_end"`
+}
+
+// previewPlanChangeHandler returns stripe's upcoming invoice for a plan change without applying it.
+// The amounts come from the invoice itself, so tax, discounts and the customer's balance are included.
+// Proration lines are what changePlanHandler invoices straight away, the other lines are the next renewal.
+// The returned proration_date can be posted to the change endpoint to get the same amounts.
+func previewPlanChangeHandler(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		owned, err := findOwnedSubscription(app, c)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"failure": err.Error()})
+		}
+
+		change, item, err := resolvePlanChange(app, c, owned)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": err.Error()})
+		}
+
+		prorationDate := change.ProrationDate
+		if prorationDate <= 0 {
+			prorationDate = time.Now().Unix()
+		}
+
+		upcoming, err := invoice.Upcoming(&stripe.InvoiceUpcomingParams{
+			Customer:     stripe.String(owned.stripe.Customer.ID),
+			Subscription: stripe.String(owned.stripe.ID),
+			SubscriptionItems: []*stripe.SubscriptionItemsParams{
+				{
+					ID:       stripe.String(item.ID),
+					Price:    stripe.String(change.PriceId),
+					Quantity: change.quantity(),
+				},
+			},
+			SubscriptionProrationBehavior: stripe.String(planChangeProration),
+			SubscriptionProrationDate:     stripe.Int64(prorationDate),
+		})
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "Could not preview plan change"})
+		}
+
+		// the lines are only the breakdown, the invoice only carries their first page
+		iter := invoice.UpcomingLines(&stripe.InvoiceUpcomingLinesParams{
+			Customer:     stripe.String(owned.stripe.Customer.ID),
+			Subscription: stripe.String(owned.stripe.ID),
+			SubscriptionItems: []*stripe.InvoiceUpcomingLinesSubscriptionItemParams{
+				{
+					ID:       stripe.String(item.ID),
+					Price:    stripe.String(change.PriceId),
+					Quantity: change.quantity(),
+				},
+			},
+			SubscriptionProrationBehavior: stripe.String(planChangeProration),
+			SubscriptionProrationDate:     stripe.Int64(prorationDate),
+		})
+
+		prorations := []prorationLine{}
+		var nextRenewalAmount int64
+		nextRenewalAt := ""
+		for iter.Next() {
+			line := iter.InvoiceLineItem()
+
+			if !line.Proration {
+				nextRenewalAmount += line.Amount
+				if line.Period != nil {
+					nextRenewalAt = mapping.Date(line.Period.Start)
+				}
+				continue
+			}
+
+			entry := prorationLine{
+				Description: line.Description,
+				Amount:      line.Amount,
+				Quantity:    line.Quantity,
+			}
+			if line.Price != nil {
+				entry.PriceId = line.Price.ID
+			}
+			if line.Period != nil {
+				entry.PeriodStart = mapping.Date(line.Period.Start)
+				entry.PeriodEnd = mapping.Date(line.Period.End)
+			}
+			prorations = append(prorations, entry)
+		}
+		if err := iter.Err(); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "Could not preview plan change"})
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"currency":            string(upcoming.Currency),
+			"proration_date":      prorationDate,
+			"proration_lines":     prorations,
+			"amount_due_now":      upcoming.AmountDue,
+			"total":               upcoming.Total,
+			"tax":                 upcoming.Tax,
+			"credit":              max(-upcoming.Total, 0),
+			"next_renewal_amount": nextRenewalAmount,
+			"next_renewal_at":     nextRenewalAt,
+		})
+	}
+}
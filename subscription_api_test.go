@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v5"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+func TestResolvePlanChangeQuantity(t *testing.T) {
+	app := newTestApp(t)
+	createTestRecord(t, app, "product", map[string]any{"product_id": "prod_test", "active": true})
+	createTestRecord(t, app, "price", map[string]any{"price_id": "price_seats", "product_id": "prod_test", "active": true, "type": "recurring", "usage_type": "licensed"})
+	createTestRecord(t, app, "price", map[string]any{"price_id": "price_calls", "product_id": "prod_test", "active": true, "type": "recurring", "usage_type": "metered"})
+
+	owned := &ownedSubscription{
+		stripe: testSubscription(testSubscriptionItem("si_base", "price_basic", 3)),
+	}
+
+	scenarios := []struct {
+		body     string
+		expected *int64
+	}{
+		{`{"price_id": "price_seats"}`, stripe.Int64(3)},
+		{`{"price_id": "price_seats", "quantity": 5}`, stripe.Int64(5)},
+		// stripe rejects a quantity on metered items
+		{`{"price_id": "price_calls"}`, nil},
+		{`{"price_id": "price_calls", "quantity": 5}`, nil},
+	}
+
+	for _, s := range scenarios {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(s.body))
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+
+		change, _, err := resolvePlanChange(app, c, owned)
+		if err != nil {
+			t.Fatalf("%s: %v", s.body, err)
+		}
+
+		quantity := change.quantity()
+		switch {
+		case s.expected == nil && quantity != nil:
+			t.Errorf("%s: expected no quantity, got %d", s.body, *quantity)
+		case s.expected != nil && (quantity == nil || *quantity != *s.expected):
+			t.Errorf("%s: expected quantity %d, got %v", s.body, *s.expected, quantity)
+		}
+	}
+}
+
+func TestResolvePlanChangeSeatQuantity(t *testing.T) {
+	app := newTestApp(t)
+	createTestRecord(t, app, "product", map[string]any{"product_id": "prod_team", "active": true, "metadata": map[string]string{"seat_based": "true"}})
+	createTestRecord(t, app, "price", map[string]any{"price_id": "price_team", "product_id": "prod_team", "active": true, "type": "recurring", "usage_type": "licensed"})
+	for _, username := range []string{"one", "two", "three"} {
+		createTestRecord(t, app, "user", map[string]any{
+			"username":        username,
+			"displayName":     username,
+			"lastSeen":        "2024-01-01 00:00:00.000Z",
+			"role":            "User",
+			"organisation_id": "org1",
+		})
+	}
+
+	owned := &ownedSubscription{
+		owner:  billingOwner{organisationId: "org1"},
+		stripe: testSubscription(testSubscriptionItem("si_base", "price_team", 3)),
+	}
+
+	// the member count wins over anything the client sends
+	for _, body := range []string{`{"price_id": "price_team"}`, `{"price_id": "price_team", "quantity": 1}`, `{"price_id": "price_team", "quantity": 50}`} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+
+		change, _, err := resolvePlanChange(app, c, owned)
+		if err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		if quantity := change.quantity(); quantity == nil || *quantity != 3 {
+			t.Errorf("%s: expected the member count 3, got %v", body, quantity)
+		}
+	}
+}
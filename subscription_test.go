@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pocketbase/dbx"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+func testSubscription(items ...*stripe.SubscriptionItem) *stripe.Subscription {
+	return &stripe.Subscription{
+		ID:       "sub_test",
+		Customer: &stripe.Customer{ID: "cus_test"},
+		Status:   stripe.SubscriptionStatusActive,
+		Items: &stripe.SubscriptionItemList{
+			Data: items,
+		},
+	}
+}
+
+func testSubscriptionItem(itemId string, priceId string, quantity int64) *stripe.SubscriptionItem {
+	return &stripe.SubscriptionItem{
+		ID:       itemId,
+		Quantity: quantity,
+		Price: &stripe.Price{
+			ID:        priceId,
+			Product:   &stripe.Product{ID: "prod_test"},
+			Recurring: &stripe.PriceRecurring{UsageType: stripe.PriceRecurringUsageTypeLicensed},
+		},
+	}
+}
+
+func TestUpsertSubscriptionSyncsItems(t *testing.T) {
+	app := newTestApp(t)
+	owner := billingOwner{userId: "u1"}
+
+	subscription := testSubscription(
+		testSubscriptionItem("si_base", "price_basic", 1),
+		testSubscriptionItem("si_addon", "price_addon", 2),
+	)
+	if _, _, err := upsertSubscription(app, nil, subscription, owner, 10, false); err != nil {
+		t.Fatal(err)
+	}
+	if count := countTestRecords(t, app, "subscription_item", dbx.HashExp{"subscription_id": "sub_test"}); count != 2 {
+		t.Fatalf("expected 2 subscription items, got %d", count)
+	}
+
+	// a plan change swaps the base price and drops the add-on
+	record, err := app.Dao().FindFirstRecordByData("subscription", "subscription_id", "sub_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := testSubscription(testSubscriptionItem("si_base", "price_pro", 1))
+	if _, _, err := upsertSubscription(app, record, changed, owner, 20, false); err != nil {
+		t.Fatal(err)
+	}
+
+	priceIds := subscriptionPriceIds(app, record)
+	if len(priceIds) != 1 || priceIds[0] != "price_pro" {
+		t.Fatalf("expected the items to have the new price only, got %v", priceIds)
+	}
+}
+
+func TestUpsertSubscriptionDryRunLeavesItems(t *testing.T) {
+	app := newTestApp(t)
+
+	subscription := testSubscription(testSubscriptionItem("si_base", "price_basic", 1))
+	if _, _, err := upsertSubscription(app, nil, subscription, billingOwner{userId: "u1"}, 10, true); err != nil {
+		t.Fatal(err)
+	}
+	if count := countTestRecords(t, app, "subscription_item", dbx.HashExp{"subscription_id": "sub_test"}); count != 0 {
+		t.Fatalf("expected a dry run not to write items, got %d", count)
+	}
+}
+
+func TestSyncSubscriptionIgnoresEventsOlderThanAnUnchangedOne(t *testing.T) {
+	app := newTestApp(t)
+	createTestRecord(t, app, "customer", map[string]any{"stripe_customer_id": "cus_test", "user_id": "u1"})
+
+	active := testSubscription(testSubscriptionItem("si_base", "price_basic", 1))
+	pastDue := testSubscription(testSubscriptionItem("si_base", "price_basic", 1))
+	pastDue.Status = stripe.SubscriptionStatusPastDue
+
+	// A at 10, C at 30 with the same data as A, then B from 20 arrives late
+	for _, event := range []struct {
+		subscription *stripe.Subscription
+		created      int64
+	}{{active, 10}, {active, 30}, {pastDue, 20}} {
+		if err := syncSubscription(app, event.subscription, event.created); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record, err := app.Dao().FindFirstRecordByData("subscription", "subscription_id", "sub_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.GetString("status") != "active" || record.GetInt("last_event_at") != 30 {
+		t.Fatalf("expected the stale event to be ignored, got %s at %d", record.GetString("status"), record.GetInt("last_event_at"))
+	}
+}
+
+func TestSyncSubscriptionAppliesEventsAfterARepair(t *testing.T) {
+	app := newTestApp(t)
+	createTestRecord(t, app, "customer", map[string]any{"stripe_customer_id": "cus_test", "user_id": "u1"})
+
+	active := testSubscription(testSubscriptionItem("si_base", "price_basic", 1))
+	if err := syncSubscription(app, active, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// a repair outside of an event, e.g. the drift check, mustn't move last_event_at to the local clock
+	record, err := app.Dao().FindFirstRecordByData("subscription", "subscription_id", "sub_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pastDue := testSubscription(testSubscriptionItem("si_base", "price_basic", 1))
+	pastDue.Status = stripe.SubscriptionStatusPastDue
+	if _, _, err := upsertSubscription(app, record, pastDue, billingOwner{userId: "u1"}, noEvent, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// an event stripe created after the repair, stamped earlier than the server's clock
+	canceled := testSubscription(testSubscriptionItem("si_base", "price_basic", 1))
+	canceled.Status = stripe.SubscriptionStatusCanceled
+	if err := syncSubscription(app, canceled, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err = app.Dao().FindFirstRecordByData("subscription", "subscription_id", "sub_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.GetString("status") != "canceled" || record.GetInt("last_event_at") != 20 || record.GetInt("synced_at") == 0 {
+		t.Fatalf("expected the event to apply after the repair, got %s at %d, synced at %d", record.GetString("status"), record.GetInt("last_event_at"), record.GetInt("synced_at"))
+	}
+}
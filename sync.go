@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const (
+	syncCreated   = "created"
+	syncUpdated   = "updated"
+	syncUnchanged = "unchanged"
+)
+
+// noEvent is passed as the event timestamp for data pocketbase fetched from the stripe api itself,
+// e.g. by the drift check or after changing a subscription
+const noEvent = 0
+
+// bookkeepingFields are numbers that only move forward. They are saved whenever they go up,
+// even when nothing else changed, but don't count as a change on their own.
+var bookkeepingFields = map[string]bool{
+	"last_event_at": true,
+	"synced_at":     true,
+}
+
+// setSyncTimestamp stamps data from an event with the event's stripe timestamp in last_event_at,
+// which stale events are compared against. Data fetched outside of an event gets the local
+// time in synced_at instead, so a server clock ahead of stripe's can't make real events look stale.
+func setSyncTimestamp(data map[string]any, eventCreated int64) {
+	if eventCreated == noEvent {
+		data["synced_at"] = time.Now().Unix()
+		return
+	}
+	data["last_event_at"] = eventCreated
+}
+
+// saveRecordData upserts data onto the existing record, or a new record of the collection
+// when there is none. It returns whether the record was created, updated or unchanged and
+// the fields that changed. With dryRun set nothing is written.
+func saveRecordData(app *pocketbase.PocketBase, collectionName string, existingRecord *models.Record, data map[string]any, dryRun bool) (string, []string, error) {
+	record := existingRecord
+	result := syncUpdated
+	if record == nil {
+		collection, err := app.Dao().FindCollectionByNameOrId(collectionName)
+		if err != nil {
+			return "", nil, err
+		}
+		record = models.NewRecord(collection)
+		result = syncCreated
+	}
+
+	changed := changedFields(record, data)
+	if result == syncUpdated && len(changed) == 0 {
+		// a newer event with the same data still has to move last_event_at on,
+		// otherwise an older event arriving later wouldn't be recognised as stale
+		advanced := advancedBookkeeping(record, data)
+		if !dryRun && len(advanced) > 0 {
+			if err := submitRecordData(app, record, advanced); err != nil {
+				return "", nil, err
+			}
+		}
+		return syncUnchanged, nil, nil
+	}
+
+	if dryRun {
+		return result, changed, nil
+	}
+
+	if err := submitRecordData(app, record, data); err != nil {
+		return "", nil, err
+	}
+
+	return result, changed, nil
+}
+
+func submitRecordData(app *pocketbase.PocketBase, record *models.Record, data map[string]any) error {
+	form := forms.NewRecordUpsert(app, record)
+	form.LoadData(data)
+
+	// validate and submit (internally it calls app.Dao().SaveRecord(record) in a transaction)
+	return form.Submit()
+}
+
+// advancedBookkeeping returns the bookkeeping fields of data that are ahead of the record's
+func advancedBookkeeping(record *models.Record, data map[string]any) map[string]any {
+	advanced := map[string]any{}
+	updated := record.CleanCopy()
+
+	for key, value := range data {
+		if !bookkeepingFields[key] {
+			continue
+		}
+		updated.Set(key, plainValue(value))
+		if updated.GetFloat(key) > record.GetFloat(key) {
+			advanced[key] = value
+		}
+	}
+
+	return advanced
+}
+
+// changedFields lists the keys of data whose normalized value differs from the record's
+func changedFields(record *models.Record, data map[string]any) []string {
+	updated := record.CleanCopy()
+	changed := []string{}
+
+	for key, value := range data {
+		if bookkeepingFields[key] {
+			continue
+		}
+		updated.Set(key, plainValue(value))
+		if !sameValue(record.Get(key), updated.Get(key)) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+
+	return changed
+}
+
+// plainValue turns named string types like stripe.SubscriptionStatus into a string,
+// record.Set only casts plain strings and would otherwise store them as empty
+func plainValue(value any) any {
+	if v := reflect.ValueOf(value); v.Kind() == reflect.String {
+		return v.String()
+	}
+	return value
+}
+
+// sameValue compares two record values by their json representation,
+// so that e.g. json fields and dates compare by content
+func sameValue(a any, b any) bool {
+	if reflect.DeepEqual(a, b) {
+		return true
+	}
+
+	rawA, errA := json.Marshal(a)
+	rawB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(rawA) == string(rawB)
+}
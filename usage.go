@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v5"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/usagerecord"
+)
+
+// usage_event statuses
+const (
+	usagePending  = "pending"
+	usageReported = "reported"
+	// no live subscription has a metered price for the meter, the usage isn't billed
+	usageUnbilled = "unbilled"
+)
+
+var errNoMeteredItem = errors.New("no live subscription has a metered price for the meter")
+
+// UsageEvent is usage of a meter by a user, or an organisation when OrganisationId is set.
+// A metered price is reported for the meter named in its stripe metadata, e.g. "meter": "api_calls".
+type UsageEvent struct {
+	UserId         string `json:"user_id"`
+	OrganisationId string `json:"organisation_id"`
+	Meter          string `json:"meter"`
+	Quantity       int64  `json:"quantity"`
+	// optional, an event with a key that was already recorded is ignored
+	IdempotencyKey string    `json:"idempotency_key"`
+	OccurredAt     time.Time `json:"occurred_at"`
+}
+
+// RecordUsage stores the usage event to be pushed to stripe by the usage job. Recording an
+// idempotency key that already exists returns the existing record.
+func RecordUsage(app *pocketbase.PocketBase, event UsageEvent) (*models.Record, error) {
+	if event.Meter == "" {
+		return nil, errors.New("meter is required")
+	}
+	if event.Quantity < 1 {
+		return nil, errors.New("quantity must be at least 1")
+	}
+	if (event.UserId == "") == (event.OrganisationId == "") {
+		return nil, errors.New("usage belongs to either a user or an organisation")
+	}
+	if event.OccurredAt.IsZero() || event.OccurredAt.After(time.Now()) {
+		event.OccurredAt = time.Now()
+	}
+
+	if event.IdempotencyKey != "" {
+		if existing, err := app.Dao().FindFirstRecordByData("usage_event", "idempotency_key", event.IdempotencyKey); err == nil {
+			return existing, nil
+		}
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("usage_event")
+	if err != nil {
+		return nil, err
+	}
+
+	occurredAt, err := types.ParseDateTime(event.OccurredAt)
+	if err != nil {
+		return nil, err
+	}
+
+	record := models.NewRecord(collection)
+	form := forms.NewRecordUpsert(app, record)
+	form.LoadData(map[string]any{
+		"user_id":         event.UserId,
+		"organisation_id": event.OrganisationId,
+		"meter":           event.Meter,
+		"quantity":        event.Quantity,
+		"idempotency_key": event.IdempotencyKey,
+		"occurred_at":     occurredAt,
+		"status":          usagePending,
+	})
+	if err := form.Submit(); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// recordUsageHandler records usage for any user or organisation, so it is only open to admins,
+// e.g. your own backend authenticated as one. A user role can't be trusted here since users
+// pick their role when signing up.
+func recordUsageHandler(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Get(apis.ContextAdminKey) == nil {
+			return c.JSON(http.StatusForbidden, map[string]string{"failure": "only admins can record usage"})
+		}
+
+		var event UsageEvent
+		payload, _ := io.ReadAll(c.Request().Body)
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "invalid usage event"})
+		}
+
+		record, err := RecordUsage(app, event)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": err.Error()})
+		}
+
+		return c.JSON(http.StatusOK, record)
+	}
+}
+
+// usageSummary is the usage of one meter in a billing period
+type usageSummary struct {
+	Meter       string `json:"meter"`
+	Quantity    int64  `json:"quantity"`
+	Reported    int64  `json:"reported"`
+	Pending     int64  `json:"pending"`
+	PeriodStart string `json:"period_start"`
+	PeriodEnd   string `json:"period_end"`
+}
+
+// usageSummaryHandler returns the requesting user's usage per meter in the current period of their
+// subscription, or their organisation's usage with ?organisation_id= for organisation members.
+// Without a live subscription the current calendar month is used.
+func usageSummaryHandler(app *pocketbase.PocketBase) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user, err := requestUser(app, c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "Could not get user"})
+		}
+
+		owner := billingOwner{userId: user.Id}
+		if organisationId := c.QueryParam("organisation_id"); organisationId != "" {
+			if user.GetString("organisation_id") != organisationId {
+				return c.JSON(http.StatusForbidden, map[string]string{"failure": "not a member of the organisation"})
+			}
+			owner = billingOwner{organisationId: organisationId}
+		}
+
+		periodStart, periodEnd := usagePeriod(app, owner)
+
+		field, ownerId := owner.customerFilter()
+		records, err := app.Dao().FindRecordsByFilter(
+			"usage_event",
+			field+" = {:owner} && occurred_at >= {:start} && occurred_at < {:end}",
+			"",
+			0,
+			0,
+			dbx.Params{"owner": ownerId, "start": periodStart.String(), "end": periodEnd.String()},
+		)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"failure": "Could not get usage"})
+		}
+
+		summaries := map[string]*usageSummary{}
+		for _, record := range records {
+			meter := record.GetString("meter")
+			if summaries[meter] == nil {
+				summaries[meter] = &usageSummary{Meter: meter, PeriodStart: periodStart.String(), PeriodEnd: periodEnd.String()}
+			}
+			quantity := int64(record.GetInt("quantity"))
+			summaries[meter].Quantity += quantity
+			switch record.GetString("status") {
+			case usageReported:
+				summaries[meter].Reported += quantity
+			case usagePending:
+				summaries[meter].Pending += quantity
+			}
+		}
+
+		result := make([]*usageSummary, 0, len(summaries))
+		for _, summary := range summaries {
+			result = append(result, summary)
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Meter < result[j].Meter })
+
+		return c.JSON(http.StatusOK, result)
+	}
+}
+
+// usagePeriod returns the current period of the owner's live subscription, or the current month
+func usagePeriod(app *pocketbase.PocketBase, owner billingOwner) (types.DateTime, types.DateTime) {
+	field, ownerId := owner.customerFilter()
+	records, err := app.Dao().FindRecordsByFilter(
+		"subscription",
+		field+" = {:owner} && (status = 'active' || status = 'trialing' || status = 'past_due')",
+		"-current_period_start",
+		1,
+		0,
+		dbx.Params{"owner": ownerId},
+	)
+	if err == nil && len(records) > 0 {
+		return records[0].GetDateTime("current_period_start"), records[0].GetDateTime("current_period_end")
+	}
+
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	start, _ := types.ParseDateTime(monthStart)
+	end, _ := types.ParseDateTime(monthStart.AddDate(0, 1, 0))
+	return start, end
+}
+
+// startUsageReporting schedules the usage push with STRIPE_USAGE_SCHEDULE (every 5 minutes by default).
+// Set the schedule to "off" to disable it.
+func startUsageReporting(app *pocketbase.PocketBase) *cron.Cron {
+	schedule := os.Getenv("STRIPE_USAGE_SCHEDULE")
+	if schedule == "" {
+		schedule = "*/5 * * * *"
+	}
+
+	scheduler := cron.New()
+	if schedule == "off" {
+		return scheduler
+	}
+
+	scheduler.MustAdd("stripe_usage", schedule, func() {
+		if err := reportUsage(app); err != nil {
+			app.Logger().Error("stripe usage reporting failed", "error", err)
+		}
+	})
+	scheduler.Start()
+
+	return scheduler
+}
+
+// reportUsage pushes the pending usage events to stripe as usage records, one per owner and meter.
+// Each batch gets its idempotency key saved on its events before it is sent, so a batch that
+// failed or whose result wasn't saved is sent again with the same key and stripe doesn't count it twice.
+func reportUsage(app *pocketbase.PocketBase) error {
+	records, err := app.Dao().FindRecordsByFilter("usage_event", "status = 'pending'", "occurred_at", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	batches := map[string][]*models.Record{}
+	for _, record := range records {
+		key := record.GetString("batch_key")
+		if key == "" {
+			key = "new:" + record.GetString("user_id") + ":" + record.GetString("organisation_id") + ":" + record.GetString("meter")
+		}
+		batches[key] = append(batches[key], record)
+	}
+
+	for key, events := range batches {
+		if strings.HasPrefix(key, "new:") {
+			if key, err = assignUsageBatch(app, events); err != nil {
+				return err
+			}
+		}
+		if err := pushUsageBatch(app, key, events); err != nil {
+			app.Logger().Error("couldn't report usage batch", "batch", key, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// assignUsageBatch saves the batch key, derived from the event ids, on the events
+func assignUsageBatch(app *pocketbase.PocketBase, events []*models.Record) (string, error) {
+	ids := make([]string, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.Id)
+	}
+	sort.Strings(ids)
+	hash := sha256.Sum256([]byte(strings.Join(ids, ",")))
+	key := "usage-" + hex.EncodeToString(hash[:16])
+
+	for _, event := range events {
+		form := forms.NewRecordUpsert(app, event)
+		form.LoadData(map[string]any{"batch_key": key})
+		if err := form.Submit(); err != nil {
+			return "", err
+		}
+	}
+
+	return key, nil
+}
+
+func pushUsageBatch(app *pocketbase.PocketBase, key string, events []*models.Record) error {
+	first := events[0]
+	owner := billingOwner{userId: first.GetString("user_id"), organisationId: first.GetString("organisation_id")}
+	meter := first.GetString("meter")
+
+	var quantity int64
+	for _, event := range events {
+		quantity += int64(event.GetInt("quantity"))
+	}
+
+	data := map[string]any{}
+	itemId, err := meteredSubscriptionItem(app, owner, meter)
+	if err != nil && !errors.Is(err, errNoMeteredItem) {
+		return err
+	}
+	if err != nil {
+		data["status"] = usageUnbilled
+		data["error"] = err.Error()
+	} else {
+		params := &stripe.UsageRecordParams{
+			SubscriptionItem: stripe.String(itemId),
+			Quantity:         stripe.Int64(quantity),
+			Action:           stripe.String("increment"),
+			TimestampNow:     stripe.Bool(true),
+		}
+		params.SetIdempotencyKey(key)
+
+		usageRecord, err := usagerecord.New(params)
+		if err != nil {
+			return err
+		}
+
+		data["status"] = usageReported
+		data["error"] = ""
+		data["subscription_item_id"] = itemId
+		data["usage_record_id"] = usageRecord.ID
+		data["reported_at"] = types.NowDateTime()
+	}
+
+	for _, event := range events {
+		form := forms.NewRecordUpsert(app, event)
+		form.LoadData(data)
+		if err := form.Submit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// meteredSubscriptionItem finds the item of the owner's live subscriptions whose metered price reports the meter
+func meteredSubscriptionItem(app *pocketbase.PocketBase, owner billingOwner, meter string) (string, error) {
+	field, ownerId := owner.customerFilter()
+	records, err := app.Dao().FindRecordsByFilter(
+		"subscription",
+		field+" = {:owner} && (status = 'active' || status = 'trialing' || status = 'past_due')",
+		"",
+		0,
+		0,
+		dbx.Params{"owner": ownerId},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	for _, record := range records {
+		items, err := app.Dao().FindRecordsByExpr("subscription_item", dbx.HashExp{"subscription_id": record.GetString("subscription_id")})
+		if err != nil {
+			return "", err
+		}
+		for _, item := range items {
+			if isMeterPrice(app, item.GetString("price_id"), meter) {
+				return item.GetString("item_id"), nil
+			}
+		}
+	}
+
+	return "", errNoMeteredItem
+}
+
+func isMeterPrice(app *pocketbase.PocketBase, priceId string, meter string) bool {
+	priceRecord, err := app.Dao().FindFirstRecordByData("price", "price_id", priceId)
+	if err != nil || priceRecord.GetString("usage_type") != "metered" {
+		return false
+	}
+
+	metadata := map[string]string{}
+	if err := priceRecord.UnmarshalJSONField("metadata", &metadata); err != nil {
+		return false
+	}
+	return metadata["meter"] == meter
+}
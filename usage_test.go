@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/tokens"
+)
+
+func TestRecordUsageRejectsUsers(t *testing.T) {
+	app := newTestApp(t)
+	router, err := apis.InitApi(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.POST("/billing/usage", recordUsageHandler(app))
+
+	// role is picked by the user at sign-up, so Service mustn't open the endpoint
+	user := createTestRecord(t, app, "user", map[string]any{
+		"username":    "service",
+		"displayName": "Service",
+		"lastSeen":    "2024-01-01 00:00:00.000Z",
+		"role":        "Service",
+	})
+	token, err := tokens.NewRecordAuthToken(app, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/billing/usage", strings.NewReader(`{"user_id": "victim", "meter": "api_calls", "quantity": 5}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", token)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d %s", rec.Code, rec.Body.String())
+	}
+	if count := countTestRecords(t, app, "usage_event", nil); count != 0 {
+		t.Fatalf("expected no usage to be recorded, got %d events", count)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/routine"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/customer"
+	stripeSubscription "github.com/stripe/stripe-go/v76/subscription"
+)
+
+// what happens to the stripe customer and subscriptions of a deleted user, set with STRIPE_USER_DELETE_POLICY
+const (
+	// leave the customer and subscriptions in stripe as they are
+	userDeleteRetain = "retain"
+	// cancel the live subscriptions straight away and delete the customer
+	userDeleteCancel = "cancel"
+	// refuse to delete users with live subscriptions
+	userDeleteBlock = "block"
+)
+
+// userDeletePolicy returns STRIPE_USER_DELETE_POLICY, retaining everything by default
+func userDeletePolicy() string {
+	switch policy := os.Getenv("STRIPE_USER_DELETE_POLICY"); policy {
+	case userDeleteCancel, userDeleteBlock:
+		return policy
+	default:
+		return userDeleteRetain
+	}
+}
+
+// customerName is the name of the user as it's shown on the stripe customer
+func customerName(user *models.Record) string {
+	if displayName := user.GetString("displayName"); displayName != "" {
+		return displayName
+	}
+	return strings.TrimSpace(user.GetString("firstName") + " " + user.GetString("lastName"))
+}
+
+// liveSubscriptions returns the user's own subscriptions that haven't ended, organisation ones aren't included
+func liveSubscriptions(app *pocketbase.PocketBase, userId string) ([]*models.Record, error) {
+	return app.Dao().FindRecordsByFilter(
+		"subscription",
+		"user_id = {:user} && status != 'canceled' && status != 'incomplete_expired'",
+		"",
+		0,
+		0,
+		dbx.Params{"user": userId},
+	)
+}
+
+// pushCustomerProfile copies the user's email and name to their stripe customer.
+// The customer record picks the change up from the customer.updated webhook.
+func pushCustomerProfile(app *pocketbase.PocketBase, user *models.Record) error {
+	customerRecord, err := activeCustomer(app, billingOwner{userId: user.Id})
+	if err != nil {
+		// no customer yet, checkout creates it with the current values
+		return nil
+	}
+
+	_, err = customer.Update(customerRecord.GetString("stripe_customer_id"), &stripe.CustomerParams{
+		Email: stripe.String(user.GetString("email")),
+		Name:  stripe.String(customerName(user)),
+	})
+	if err != nil {
+		return errors.New("couldn't update customer in stripe")
+	}
+
+	return nil
+}
+
+// cancelUserBilling cancels the live subscriptions of a deleted user and deletes their stripe customer
+func cancelUserBilling(app *pocketbase.PocketBase, userId string) error {
+	subscriptions, err := liveSubscriptions(app, userId)
+	if err != nil {
+		return err
+	}
+	for _, subscription := range subscriptions {
+		if _, err := stripeSubscription.Cancel(subscription.GetString("subscription_id"), nil); err != nil {
+			return errors.New("couldn't cancel subscription in stripe")
+		}
+	}
+
+	customerRecord, err := activeCustomer(app, billingOwner{userId: userId})
+	if err != nil {
+		return nil
+	}
+	if _, err := customer.Del(customerRecord.GetString("stripe_customer_id"), nil); err != nil {
+		return errors.New("couldn't delete customer in stripe")
+	}
+
+	return markCustomerDeleted(app, customerRecord.GetString("stripe_customer_id"))
+}
+
+// registerUserHooks keeps the stripe customer in line with its user and applies the delete policy
+func registerUserHooks(app *pocketbase.PocketBase) {
+	app.OnModelAfterUpdate("user").Add(func(e *core.ModelEvent) error {
+		record := e.Model.(*models.Record)
+		original := record.OriginalCopy()
+		if original.GetString("email") == record.GetString("email") && customerName(original) == customerName(record) {
+			return nil
+		}
+
+		user := record.CleanCopy()
+		routine.FireAndForget(func() {
+			if err := pushCustomerProfile(app, user); err != nil {
+				app.Logger().Error("customer profile update failed", "user", user.Id, "error", err)
+			}
+		})
+		return nil
+	})
+
+	app.OnModelBeforeDelete("user").Add(func(e *core.ModelEvent) error {
+		if userDeletePolicy() != userDeleteBlock {
+			return nil
+		}
+
+		subscriptions, err := liveSubscriptions(app, e.Model.GetId())
+		if err != nil {
+			return err
+		}
+		if len(subscriptions) > 0 {
+			return errors.New("the user has subscriptions that haven't ended, cancel them before deleting the user")
+		}
+		return nil
+	})
+
+	app.OnModelAfterDelete("user").Add(func(e *core.ModelEvent) error {
+		if userDeletePolicy() != userDeleteCancel {
+			return nil
+		}
+
+		userId := e.Model.GetId()
+		routine.FireAndForget(func() {
+			if err := cancelUserBilling(app, userId); err != nil {
+				app.Logger().Error("cancelling billing of deleted user failed", "user", userId, "error", err)
+			}
+		})
+		return nil
+	})
+}
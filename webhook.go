@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/pocketbase/pocketbase"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+// errUnhandledEvent is returned for verified events that nothing is listening to.
+// They are acknowledged and marked as ignored rather than retried.
+var errUnhandledEvent = errors.New("didn't receive a valid event")
+
+// handleStripeEvent applies a verified stripe event to the pocketbase collections
+func handleStripeEvent(app *pocketbase.PocketBase, event stripe.Event) error {
+	switch event.Type {
+	case "product.created", "product.updated":
+		var product stripe.Product
+		err := json.Unmarshal(event.Data.Raw, &product)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if _, _, err := syncProduct(app, &product, false); err != nil {
+			return err
+		}
+	case "product.deleted":
+		var product stripe.Product
+		err := json.Unmarshal(event.Data.Raw, &product)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if err := markProductDeleted(app, product.ID); err != nil {
+			return err
+		}
+	case "price.deleted":
+		var price stripe.Price
+		err := json.Unmarshal(event.Data.Raw, &price)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if err := markPriceDeleted(app, price.ID); err != nil {
+			return err
+		}
+	case "price.created", "price.updated":
+		var price stripe.Price
+		err := json.Unmarshal(event.Data.Raw, &price)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if _, _, err := syncPrice(app, &price, false); err != nil {
+			return err
+		}
+	case "customer.created", "customer.updated":
+		var customer stripe.Customer
+		err := json.Unmarshal(event.Data.Raw, &customer)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if err := syncCustomer(app, &customer, event.Created); err != nil {
+			return err
+		}
+	case "customer.deleted":
+		var customer stripe.Customer
+		err := json.Unmarshal(event.Data.Raw, &customer)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if err := markCustomerDeleted(app, customer.ID); err != nil {
+			return err
+		}
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		var subscription stripe.Subscription
+		err := json.Unmarshal(event.Data.Raw, &subscription)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if err := syncSubscription(app, &subscription, event.Created); err != nil {
+			return err
+		}
+	case "checkout.session.completed":
+		var session stripe.CheckoutSession
+		err := json.Unmarshal(event.Data.Raw, &session)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if session.Mode == "subscription" {
+			if session.Subscription == nil {
+				return errors.New("checkout session has no subscription")
+			}
+			if err := syncSubscription(app, session.Subscription, event.Created); err != nil {
+				return err
+			}
+		} else if session.Mode == "payment" {
+			if err := syncCheckoutOrder(app, &session); err != nil {
+				return err
+			}
+		}
+	case "payment_intent.succeeded":
+		var paymentIntent stripe.PaymentIntent
+		err := json.Unmarshal(event.Data.Raw, &paymentIntent)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if err := syncPaymentIntentOrder(app, &paymentIntent); err != nil {
+			return err
+		}
+	case "invoice.created", "invoice.finalized", "invoice.paid", "invoice.payment_failed", "invoice.voided", "invoice.marked_uncollectible":
+		var invoice stripe.Invoice
+		err := json.Unmarshal(event.Data.Raw, &invoice)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if err := syncInvoice(app, &invoice, event.Created); err != nil {
+			return err
+		}
+	case "charge.refunded":
+		var charge stripe.Charge
+		err := json.Unmarshal(event.Data.Raw, &charge)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if err := syncChargeRefunds(app, &charge); err != nil {
+			return err
+		}
+	case "charge.dispute.created", "charge.dispute.closed":
+		var dispute stripe.Dispute
+		err := json.Unmarshal(event.Data.Raw, &dispute)
+		if err != nil {
+			return errors.New("failed to marshall the stripe event")
+		}
+		if err := syncDispute(app, &dispute, event.Type == "charge.dispute.created"); err != nil {
+			return err
+		}
+	default:
+		return errUnhandledEvent
+	}
+
+	return nil
+}
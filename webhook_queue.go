@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+const (
+	webhookQueueInterval  = 5 * time.Second
+	webhookQueueBatchSize = 50
+	webhookRetryBaseDelay = 30 * time.Second
+	webhookRetryMaxDelay  = 6 * time.Hour
+)
+
+// webhookQueue processes the queued stripe_event records in the background.
+// Failed events are retried with exponential backoff until maxAttempts is reached,
+// after which they are moved to the dead state for an admin to inspect and requeue.
+type webhookQueue struct {
+	app         *pocketbase.PocketBase
+	maxAttempts int
+	wake        chan struct{}
+	done        chan struct{}
+}
+
+func newWebhookQueue(app *pocketbase.PocketBase) *webhookQueue {
+	maxAttempts, err := strconv.Atoi(os.Getenv("STRIPE_WEBHOOK_MAX_ATTEMPTS"))
+	if err != nil || maxAttempts < 1 {
+		maxAttempts = 8
+	}
+
+	return &webhookQueue{
+		app:         app,
+		maxAttempts: maxAttempts,
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+// notify wakes the worker up without waiting for the next tick
+func (q *webhookQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *webhookQueue) start() {
+	go func() {
+		ticker := time.NewTicker(webhookQueueInterval)
+		defer ticker.Stop()
+
+		for {
+			q.processDue()
+
+			select {
+			case <-q.done:
+				return
+			case <-ticker.C:
+			case <-q.wake:
+			}
+		}
+	}()
+}
+
+func (q *webhookQueue) stop() {
+	close(q.done)
+}
+
+// processDue handles every pending or failed event whose next attempt is due.
+// It stops early when none of a batch could be saved, rather than loading the same events again.
+func (q *webhookQueue) processDue() {
+	for {
+		records, err := q.app.Dao().FindRecordsByFilter(
+			"stripe_event",
+			"(status = {:pending} || status = {:failed}) && next_attempt_at <= {:now}",
+			"received_at",
+			webhookQueueBatchSize,
+			0,
+			dbx.Params{
+				"pending": stripeEventPending,
+				"failed":  stripeEventFailed,
+				"now":     types.NowDateTime().String(),
+			},
+		)
+		if err != nil {
+			q.app.Logger().Error("failed to load queued stripe events", "error", err)
+			return
+		}
+
+		saved := 0
+		for _, record := range records {
+			if q.process(record) {
+				saved++
+			}
+		}
+
+		if len(records) < webhookQueueBatchSize || saved == 0 {
+			return
+		}
+	}
+}
+
+// process handles the event and saves the outcome on its record, returning false when that
+// couldn't be saved and the event is still due
+func (q *webhookQueue) process(record *models.Record) bool {
+	var event stripe.Event
+	handleErr := json.Unmarshal([]byte(record.GetString("payload")), &event)
+	if handleErr == nil {
+		handleErr = q.handle(event)
+	}
+
+	attempts := record.GetInt("attempts") + 1
+	data := map[string]any{
+		"attempts":     attempts,
+		"processed_at": types.NowDateTime(),
+		"status":       stripeEventProcessed,
+		"error":        "",
+	}
+
+	if errors.Is(handleErr, errUnhandledEvent) {
+		data["status"] = stripeEventIgnored
+	} else if handleErr != nil {
+		data["error"] = handleErr.Error()
+		if attempts >= q.maxAttempts {
+			data["status"] = stripeEventDead
+		} else {
+			data["status"] = stripeEventFailed
+			next, _ := types.ParseDateTime(time.Now().Add(webhookRetryDelay(attempts)))
+			data["next_attempt_at"] = next
+		}
+		q.app.Logger().Warn("failed to handle stripe event",
+			"event_id", record.GetString("event_id"),
+			"attempts", attempts,
+			"error", handleErr,
+		)
+	}
+
+	form := forms.NewRecordUpsert(q.app, record)
+	form.LoadData(data)
+	if err := form.Submit(); err != nil {
+		q.app.Logger().Error("failed to update stripe event", "event_id", record.GetString("event_id"), "error", err)
+		return false
+	}
+
+	return true
+}
+
+// handle applies the event, turning a panic in one of the handlers into a failed attempt
+func (q *webhookQueue) handle(event stripe.Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while handling event: %v", r)
+		}
+	}()
+
+	return handleStripeEvent(q.app, event)
+}
+
+// webhookRetryDelay doubles the wait after every failed attempt
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBaseDelay
+	for i := 1; i < attempts && delay < webhookRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookRetryMaxDelay)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func TestProcessDueStopsWhenNothingCanBeSaved(t *testing.T) {
+	app := newTestApp(t)
+	for i := 0; i < webhookQueueBatchSize; i++ {
+		createTestRecord(t, app, "stripe_event", map[string]any{
+			"event_id": fmt.Sprintf("evt_%d", i),
+			"type":     "test.unhandled",
+			"payload":  map[string]any{"id": fmt.Sprintf("evt_%d", i), "type": "test.unhandled"},
+			"status":   stripeEventPending,
+		})
+	}
+
+	// e.g. the database became read-only after the events were queued
+	app.OnModelBeforeUpdate("stripe_event").Add(func(e *core.ModelEvent) error {
+		return errors.New("database is read-only")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		newWebhookQueue(app).processDue()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected processDue to stop when no event of the batch could be saved")
+	}
+}